@@ -0,0 +1,2983 @@
+package awssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type config struct {
+	Columns             []column   `json:"columns"`
+	DefaultRegion       string     `json:"default-aws-region"`
+	DisableHostKeyCheck *bool      `json:"disable-host-key-check"`
+	PreferPrivateIP     *bool      `json:"prefer-private-ip"`
+	ConnectBy           string     `json:"connect-by"`
+	KeyDirs             []string   `json:"key-dirs"`
+	DefaultSSHUser      string     `json:"default-ssh-user"`
+	IgnoreKeys          *bool      `json:"ignore-keys"`
+	AlwaysConfirm       *bool      `json:"always-confirm"`
+	IndexHeader         string     `json:"index-header"`
+	KeyFromTag          string     `json:"key-from-tag"`
+	RowColors           []rowColor `json:"row-color"`
+}
+
+// rowColor colors the rows of the instance table matching an exact match
+// filter (as passed to -e).
+type rowColor struct {
+	Match string `json:"match"`
+	Color string `json:"color"`
+}
+
+// ansiColors maps the color names usable in row-color to ANSI SGR codes.
+var ansiColors = map[string]string{
+	"black":   "30",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+	"grey":    "90",
+	"gray":    "90",
+}
+
+// Exit statuses, on top of 0 for success and 1 for other errors
+const (
+	exitNoMatch     = 2
+	exitAmbiguous   = 3
+	exitAWSError    = 4
+	exitConfigError = 5
+)
+
+// runLogger prints the errors, warnings and debug messages of one Run call to
+// the stderr it is given.
+type runLogger struct {
+	*log.Logger
+	// verbose enables the debug messages logged with debugf.
+	verbose bool
+}
+
+func newRunLogger(w io.Writer) *runLogger {
+	return &runLogger{Logger: log.New(w, "", log.LstdFlags)}
+}
+
+// fatalf logs an error message and returns the given exit status.
+func (l *runLogger) fatalf(status int, format string, args ...interface{}) int {
+	l.Printf(format, args...)
+	return status
+}
+
+func (l *runLogger) debugf(format string, args ...interface{}) {
+	if l.verbose {
+		l.Printf("[debug] "+format, args...)
+	}
+}
+
+// earlyValueFlags lists the flags taking a value, so that the value of a flag
+// isn't mistaken for another flag or a command when looking up flags before the
+// regular flag parsing.
+var earlyValueFlags = map[string]bool{
+	"cache":           true,
+	"completion":      true,
+	"config":          true,
+	"connect-timeout": true,
+	"credentials":     true,
+	"e":               true,
+	"endpoint":        true,
+	"jobs":            true,
+	"l":               true,
+	"m":               true,
+	"o":               true,
+	"p":               true,
+	"profile":         true,
+	"r":               true,
+	"sg":              true,
+	"state":           true,
+	"vpc":             true,
+	"watch":           true,
+}
+
+// earlyFlag is a flag found in the command line by earlyFlags.
+type earlyFlag struct {
+	name  string
+	value string
+}
+
+// earlyFlags returns the flags set in args, stopping like the flag package at
+// the first argument that is not a flag (eg. the command to run on the
+// instance). Boolean flags are "true" unless set with the -name=value form.
+func earlyFlags(args []string) []earlyFlag {
+	flags := []earlyFlag{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+
+		if idx := strings.IndexByte(name, '='); idx != -1 {
+			flags = append(flags, earlyFlag{name[:idx], name[1+idx:]})
+			continue
+		}
+
+		value := "true"
+
+		if earlyValueFlags[name] {
+			if i+1 == len(args) {
+				break
+			}
+
+			i++
+			value = args[i]
+		}
+
+		flags = append(flags, earlyFlag{name, value})
+	}
+
+	return flags
+}
+
+// earlyBoolFlag reports whether one of the boolean flags names is set in
+// args. It is used for flags that must be known before the configuration is
+// loaded, which happens before the regular flag parsing.
+func earlyBoolFlag(args []string, names ...string) bool {
+	set := false
+
+	for _, f := range earlyFlags(args) {
+		for _, n := range names {
+			if f.name == n {
+				set, _ = strconv.ParseBool(f.value)
+			}
+		}
+	}
+
+	return set
+}
+
+// earlyStringFlag returns the value of the string flag name in args, or an
+// empty string if it is not set. Like earlyBoolFlag, it is used for flags that
+// must be known before the regular flag parsing.
+func earlyStringFlag(args []string, name string) string {
+	value := ""
+
+	for _, f := range earlyFlags(args) {
+		if f.name == name {
+			value = f.value
+		}
+	}
+
+	return value
+}
+
+// column is a column of the instance table, showing the instance field Field
+// under the given Header. In the configuration, columns are either strings of
+// the form "field" or "field=Header", or objects with a field and a header.
+type column struct {
+	Field  string `json:"field"`
+	Header string `json:"header"`
+}
+
+func (c *column) UnmarshalJSON(data []byte) error {
+	spec := ""
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		// Not a string, must be an object
+		type columnObject column
+		return json.Unmarshal(data, (*columnObject)(c))
+	}
+
+	c.Field = spec
+	c.Header = ""
+
+	if idx := strings.LastIndexByte(spec, '='); idx != -1 {
+		c.Field, c.Header = spec[:idx], spec[1+idx:]
+	}
+
+	return nil
+}
+
+// header returns the header of the column, which defaults to its field as
+// written in the configuration.
+func (c column) header() string {
+	if c.Header != "" {
+		return c.Header
+	}
+
+	return c.Field
+}
+
+// defaultColumns are displayed when no configuration file sets any columns.
+var defaultColumns = []column{{Field: "instanceId"}, {Field: "tag:Name"}, {Field: "instanceType"}, {Field: "ipAddress"}}
+
+type sshKey struct {
+	username string
+	filename string
+	options  keyOptions
+}
+
+// keyOptions are the ssh options used with a key, read from the optional
+// user@keyname.pem.json file next to it.
+type keyOptions struct {
+	Port      int      `json:"port"`
+	JumpHost  string   `json:"jumpHost"`
+	ExtraArgs []string `json:"extraArgs"`
+}
+
+// loadKeyOptions loads the options of the key stored in keyFilename, if any.
+func loadKeyOptions(keyFilename string) (keyOptions, error) {
+	options := keyOptions{}
+	data, err := ioutil.ReadFile(keyFilename + ".json")
+
+	if os.IsNotExist(err) {
+		return options, nil
+	}
+
+	if err != nil {
+		return options, err
+	}
+
+	if err := json.Unmarshal(data, &options); err != nil {
+		return options, fmt.Errorf("Error while parsing %s.json: %s", keyFilename, err)
+	}
+
+	return options, nil
+}
+
+func (c *config) Merge(other *config) {
+	if len(other.Columns) > 0 {
+		c.Columns = other.Columns
+	}
+
+	if other.DefaultRegion != "" {
+		c.DefaultRegion = other.DefaultRegion
+	}
+
+	if other.DisableHostKeyCheck != nil {
+		c.DisableHostKeyCheck = other.DisableHostKeyCheck
+	}
+
+	if other.PreferPrivateIP != nil {
+		c.PreferPrivateIP = other.PreferPrivateIP
+	}
+
+	if other.ConnectBy != "" {
+		c.ConnectBy = other.ConnectBy
+	}
+
+	if len(other.KeyDirs) > 0 {
+		c.KeyDirs = other.KeyDirs
+	}
+
+	if other.DefaultSSHUser != "" {
+		c.DefaultSSHUser = other.DefaultSSHUser
+	}
+
+	if other.IgnoreKeys != nil {
+		c.IgnoreKeys = other.IgnoreKeys
+	}
+
+	if other.AlwaysConfirm != nil {
+		c.AlwaysConfirm = other.AlwaysConfirm
+	}
+
+	if other.IndexHeader != "" {
+		c.IndexHeader = other.IndexHeader
+	}
+
+	if other.KeyFromTag != "" {
+		c.KeyFromTag = other.KeyFromTag
+	}
+
+	if len(other.RowColors) > 0 {
+		c.RowColors = other.RowColors
+	}
+}
+
+// sshUser returns the user to log in as when the key file name does not
+// specify one.
+func (c *config) sshUser() string {
+	if c.DefaultSSHUser != "" {
+		return c.DefaultSSHUser
+	}
+
+	return "ec2-user"
+}
+
+// indexHeader returns the header of the column showing the index of each
+// instance.
+func (c *config) indexHeader() string {
+	if c.IndexHeader != "" {
+		return c.IndexHeader
+	}
+
+	return "#"
+}
+
+// keyName returns the name of the key used to connect to instance: the value
+// of the tag named by key-from-tag if the instance has it, or the name of the
+// EC2 key pair of the instance.
+func (c *config) keyName(instance map[string]string) string {
+	if c.KeyFromTag != "" {
+		if name := instance["tag:"+c.KeyFromTag]; name != "" {
+			return name
+		}
+	}
+
+	return instance["keyName"]
+}
+
+// stringList is a flag.Value collecting the values of a flag that can be passed
+// several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Table styles supported by table.render
+const (
+	tableStyleBoxed    = "boxed"
+	tableStylePlain    = "plain"
+	tableStyleMarkdown = "markdown"
+)
+
+type table struct {
+	header    []string
+	rows      [][]string
+	rowColors []string
+	style     string
+}
+
+func (t *table) addRow(row []string) {
+	t.addColoredRow(row, "")
+}
+
+// addColoredRow adds a row rendered with the given ANSI SGR code (eg. "31" for
+// red) in the boxed style.
+func (t *table) addColoredRow(row []string, color string) {
+	t.rows = append(t.rows, row)
+	t.rowColors = append(t.rowColors, color)
+}
+
+var ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// visibleWidth returns the number of characters displayed for str, ignoring
+// ANSI escape sequences.
+func visibleWidth(str string) int {
+	return utf8.RuneCountInString(ansiEscapeRegexp.ReplaceAllString(str, ""))
+}
+
+func (t *table) columnWidths() []int {
+	// 1. Calculate number of columns
+	nCols := len(t.header)
+
+	for _, r := range t.rows {
+		if len(r) > nCols {
+			nCols = len(r)
+		}
+	}
+
+	if len(t.header) != nCols {
+		panic("Number of columns in rows does not match header")
+	}
+
+	// 2. Calculate column width
+	colWidth := make([]int, nCols)
+
+	updateColWidth := func(row []string) {
+		for i, col := range row {
+			if colWidth[i] < visibleWidth(col) {
+				colWidth[i] = visibleWidth(col)
+			}
+		}
+	}
+
+	updateColWidth(t.header)
+
+	for _, r := range t.rows {
+		updateColWidth(r)
+	}
+
+	return colWidth
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+
+	if !ok {
+		return false
+	}
+
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (t *table) render(out io.Writer) {
+	switch t.style {
+	case tableStylePlain:
+		t.renderPlain(out)
+	case tableStyleMarkdown:
+		t.renderMarkdown(out)
+	default:
+		t.renderBoxed(out)
+	}
+}
+
+func (t *table) renderBoxed(out io.Writer) {
+	colWidth := t.columnWidths()
+	tableWidth := 1 // left border
+
+	for _, w := range colWidth {
+		// 2 for left and right margin, 1 for border
+		tableWidth += w + 3
+	}
+
+	// Render header
+	rowBuf := bytes.NewBuffer(make([]byte, 0, tableWidth))
+
+	const topLeftCorner = '┌'
+	const topRightCorner = '┐'
+	const leftTee = '├'
+	const rightTee = '┤'
+	const border = '│'
+	const line = '─'
+	const bottomLeftCorner = '└'
+	const bottomRightCorner = '┘'
+
+	tableLine := strings.Repeat(string(line), tableWidth-2)
+
+	rowBuf.WriteRune(topLeftCorner)
+	rowBuf.WriteString(tableLine)
+	rowBuf.WriteRune(topRightCorner)
+	rowBuf.WriteString("\n")
+	out.Write(rowBuf.Bytes())
+
+	writeRow := func(row []string, color string) {
+		rowBuf.Reset()
+
+		for i, col := range row {
+			if i == 0 {
+				rowBuf.WriteRune(border)
+			}
+
+			rowBuf.WriteByte(' ')
+
+			padding := colWidth[i] - visibleWidth(col)
+
+			if color != "" {
+				col = "\x1b[" + color + "m" + col + "\x1b[0m"
+			}
+
+			rowBuf.WriteString(col)
+			rowBuf.WriteString(strings.Repeat(" ", padding))
+
+			rowBuf.WriteByte(' ')
+			rowBuf.WriteRune(border)
+		}
+
+		rowBuf.WriteByte('\n')
+
+		out.Write(rowBuf.Bytes())
+	}
+
+	writeSeparator := func() {
+		rowBuf.Reset()
+		rowBuf.WriteRune(leftTee)
+		rowBuf.WriteString(tableLine)
+		rowBuf.WriteRune(rightTee)
+		rowBuf.WriteString("\n")
+		out.Write(rowBuf.Bytes())
+	}
+
+	writeRow(t.header, "")
+	writeSeparator()
+
+	for i, r := range t.rows {
+		writeRow(r, t.rowColors[i])
+	}
+
+	rowBuf.Reset()
+	rowBuf.WriteRune(bottomLeftCorner)
+	rowBuf.WriteString(tableLine)
+	rowBuf.WriteRune(bottomRightCorner)
+	rowBuf.WriteString("\n")
+	out.Write(rowBuf.Bytes())
+}
+
+// renderPlain renders the table as tab separated values
+func (t *table) renderPlain(out io.Writer) {
+	rowBuf := bytes.NewBuffer(nil)
+
+	for _, row := range append([][]string{t.header}, t.rows...) {
+		rowBuf.WriteString(strings.Join(row, "\t"))
+		rowBuf.WriteByte('\n')
+	}
+
+	out.Write(rowBuf.Bytes())
+}
+
+// renderMarkdown renders the table as a Markdown table
+func (t *table) renderMarkdown(out io.Writer) {
+	// Pipes would end the cells early
+	escape := func(row []string) []string {
+		escaped := make([]string, len(row))
+
+		for i, col := range row {
+			escaped[i] = strings.Replace(col, "|", "\\|", -1)
+		}
+
+		return escaped
+	}
+
+	escapedTable := &table{header: escape(t.header)}
+
+	for _, r := range t.rows {
+		escapedTable.addRow(escape(r))
+	}
+
+	colWidth := escapedTable.columnWidths()
+
+	for i := range colWidth {
+		// The header separator needs at least 3 dashes
+		if colWidth[i] < 3 {
+			colWidth[i] = 3
+		}
+	}
+
+	rowBuf := bytes.NewBuffer(nil)
+
+	writeRow := func(row []string) {
+		rowBuf.WriteByte('|')
+
+		for i, col := range row {
+			rowBuf.WriteByte(' ')
+			rowBuf.WriteString(col)
+			rowBuf.WriteString(strings.Repeat(" ", colWidth[i]-utf8.RuneCountInString(col)))
+			rowBuf.WriteString(" |")
+		}
+
+		rowBuf.WriteByte('\n')
+	}
+
+	writeRow(escapedTable.header)
+
+	separator := make([]string, len(colWidth))
+
+	for i, w := range colWidth {
+		separator[i] = strings.Repeat("-", w)
+	}
+
+	writeRow(separator)
+
+	for _, r := range escapedTable.rows {
+		writeRow(r)
+	}
+
+	out.Write(rowBuf.Bytes())
+}
+
+func getConfigDirs() []string {
+	dirs := []string{}
+
+	for _, dir := range strings.Split(os.Getenv("XDG_CONFIG_DIRS"), ":") {
+		if dir == "" {
+			continue
+		}
+
+		dirs = append(dirs, dir)
+	}
+
+	if user, err := user.Current(); err == nil {
+		dirs = append(dirs, path.Join(user.HomeDir, ".config"))
+	}
+
+	dirs = append(dirs, "/etc")
+
+	return dirs
+}
+
+func loadConfigFromPath(logger *runLogger, path string) (*config, error) {
+	fd, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	data, err := ioutil.ReadAll(fd)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &config{}
+
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, err
+	}
+
+	if unknown := unknownConfigKeys(data); len(unknown) > 0 {
+		logger.Printf("Warning: ignoring unknown configuration keys in %s: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return conf, nil
+}
+
+// unknownConfigKeys returns the sorted list of toplevel keys in the JSON
+// document data that do not map to a field of the config struct.
+func unknownConfigKeys(data []byte) []string {
+	raw := map[string]json.RawMessage{}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil
+	}
+
+	known := map[string]bool{}
+	configType := reflect.TypeOf(config{})
+
+	for i := 0; i < configType.NumField(); i++ {
+		name := strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]
+
+		if name != "" {
+			known[name] = true
+		}
+	}
+
+	unknown := []string{}
+
+	for key := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// parseKeySpec splits a key spec of the form user@keyname. The username is
+// optional, and empty if spec has no @.
+func parseKeySpec(spec string) (username string, keyName string) {
+	idx := strings.IndexByte(spec, '@')
+
+	if idx == -1 {
+		return "", spec
+	}
+
+	return spec[:idx], spec[1+idx:]
+}
+
+func loadSshKeysFromDir(logger *runLogger, dirPath string) (map[string]*sshKey, error) {
+	dir, err := os.Open(dirPath)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer dir.Close()
+
+	fis, err := dir.Readdir(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(fis, func(i, j int) bool {
+		return fis[i].Name() < fis[j].Name()
+	})
+
+	keys := map[string]*sshKey{}
+
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+
+		if !strings.HasSuffix(fi.Name(), ".pem") {
+			continue
+		}
+
+		keySpec := path.Base(fi.Name())
+		keySpec = keySpec[:len(keySpec)-4]
+
+		username, keyName := parseKeySpec(keySpec)
+
+		if existing, ok := keys[keyName]; ok {
+			logger.Printf("Warning: %s and %s are both keys named %s, ignoring %s", existing.filename, path.Join(dirPath, fi.Name()), keyName, path.Join(dirPath, fi.Name()))
+			continue
+		}
+
+		filename := path.Join(dirPath, fi.Name())
+		options, err := loadKeyOptions(filename)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys[keyName] = &sshKey{
+			username: username,
+			filename: filename,
+			options:  options,
+		}
+	}
+
+	return keys, nil
+}
+
+// loadConfig loads and merges the configuration files, and the SSH keys next
+// to them, from the standard configuration directories. If configPath is set,
+// only that configuration file and the keys next to it are loaded.
+func loadConfig(logger *runLogger, configPath string) (*config, map[string]*sshKey, error) {
+	conf := &config{}
+	sshKeys := map[string]*sshKey{}
+
+	loaded := false
+
+	configFiles := []string{}
+	keysDirs := []string{}
+
+	if configPath != "" {
+		configFiles = append(configFiles, configPath)
+		keysDirs = append(keysDirs, path.Join(path.Dir(configPath), "keys"))
+	} else {
+		configDirs := getConfigDirs()
+		logger.debugf("Looking for configuration files in %s", strings.Join(configDirs, ", "))
+
+		for _, dir := range configDirs {
+			configFiles = append(configFiles, path.Join(dir, "awssh/config.json"))
+			keysDirs = append(keysDirs, path.Join(dir, "awssh/keys"))
+		}
+	}
+
+	for i, configFile := range configFiles {
+		newConf, err := loadConfigFromPath(logger, configFile)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if newConf == nil {
+			continue
+		}
+
+		logger.debugf("Loaded configuration file %s", configFile)
+		conf.Merge(newConf)
+		loaded = true
+
+		newKeys, err := loadSshKeysFromDir(logger, keysDirs[i])
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		logger.debugf("Loaded %d SSH keys from %s", len(newKeys), keysDirs[i])
+
+		for name, key := range newKeys {
+			sshKeys[name] = key
+		}
+	}
+
+	if !loaded {
+		return nil, nil, fmt.Errorf("Found no config files in %s", strings.Join(configFiles, ", "))
+	}
+
+	// Keys from the configuration directories take precedence over the ones from
+	// key-dirs, and earlier key-dirs take precedence over later ones.
+	for _, dir := range conf.KeyDirs {
+		if strings.HasPrefix(dir, "~/") {
+			if user, err := user.Current(); err == nil {
+				dir = path.Join(user.HomeDir, dir[2:])
+			}
+		}
+
+		newKeys, err := loadSshKeysFromDir(logger, dir)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		logger.debugf("Loaded %d SSH keys from %s", len(newKeys), dir)
+
+		for name, key := range newKeys {
+			if _, ok := sshKeys[name]; !ok {
+				sshKeys[name] = key
+			}
+		}
+	}
+
+	for _, key := range sshKeys {
+		if key.username == "" {
+			key.username = conf.sshUser()
+		}
+	}
+
+	return conf, sshKeys, nil
+}
+
+func camelCase(name string) string {
+	buf := bytes.NewBuffer(nil)
+
+	ucNext := false
+
+	for _, c := range name {
+		if c == '-' || c == '_' {
+			ucNext = true
+			continue
+		}
+
+		if ucNext {
+			c = unicode.ToUpper(c)
+		}
+
+		buf.WriteRune(c)
+		ucNext = false
+	}
+
+	return buf.String()
+}
+
+// columnField returns the name of the instance field displayed by a column
+// from the configuration.
+func columnField(col string) string {
+	if strings.HasPrefix(col, "tag:") {
+		return col
+	}
+
+	return camelCase(col)
+}
+
+func collectInstanceData(instance *ec2.Instance) map[string]string {
+	val := reflect.Indirect(reflect.ValueOf(instance))
+	desc := map[string]string{}
+
+	for i := 0; i < val.NumField(); i++ {
+		fieldDef := val.Type().Field(i)
+		fieldName := fieldDef.Tag.Get("locationName")
+
+		if fieldName == "" {
+			continue
+		}
+
+		field := reflect.Indirect(val.Field(i))
+
+		if !field.IsValid() {
+			continue
+		}
+
+		// Special handling for tags, also collected in a single "tags" field
+		if fieldName == "tagSet" {
+			tags := field.Interface().([]*ec2.Tag)
+			pairs := []string{}
+
+			for _, tag := range tags {
+				desc["tag:"+*tag.Key] = *tag.Value
+				pairs = append(pairs, *tag.Key+"="+*tag.Value)
+			}
+
+			sort.Strings(pairs)
+			desc["tags"] = strings.Join(pairs, ",")
+
+			continue
+		}
+
+		// Security groups are collected as comma separated lists of IDs and
+		// names
+		if fieldName == "groupSet" {
+			groups := field.Interface().([]*ec2.GroupIdentifier)
+			ids := []string{}
+			names := []string{}
+
+			for _, group := range groups {
+				ids = append(ids, aws.StringValue(group.GroupId))
+				names = append(names, aws.StringValue(group.GroupName))
+			}
+
+			desc["securityGroupIds"] = strings.Join(ids, ",")
+			desc["securityGroups"] = strings.Join(names, ",")
+
+			continue
+		}
+
+		if fieldName == "instanceState" {
+			state := field.Interface().(ec2.InstanceState)
+
+			if state.Name != nil {
+				desc["state"] = *state.Name
+			}
+		}
+
+		if fieldName == "placement" {
+			placement := field.Interface().(ec2.Placement)
+
+			if placement.AvailabilityZone != nil {
+				desc["availabilityZone"] = *placement.AvailabilityZone
+			}
+		}
+
+		desc[fieldName] = flattenValue(fmt.Sprintf("%v", field.Interface()))
+	}
+
+	return desc
+}
+
+// instanceFieldNames returns the names of the fields collectInstanceData may
+// return, besides the tag: ones.
+func instanceFieldNames() []string {
+	names := []string{"state", "availabilityZone", "securityGroupIds", "securityGroups", "tags"}
+	instanceType := reflect.TypeOf(ec2.Instance{})
+
+	for i := 0; i < instanceType.NumField(); i++ {
+		if name := instanceType.Field(i).Tag.Get("locationName"); name != "" && name != "tagSet" && name != "groupSet" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// flattenValue puts value on a single line, so that it fits in a table cell.
+// The SDK formats structures on several indented lines.
+func flattenValue(value string) string {
+	if !strings.Contains(value, "\n") {
+		return value
+	}
+
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// instanceCache stores the results of DescribeInstances calls on disk so that
+// quickly reconnecting to an instance does not require listing them again.
+type instanceCache struct {
+	dir     string
+	ttl     time.Duration
+	refresh bool
+}
+
+// lastInstance identifies the instance to which awssh last connected.
+type lastInstance struct {
+	InstanceID string `json:"instance-id"`
+	Region     string `json:"region"`
+}
+
+func getStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return path.Join(dir, "awssh")
+	}
+
+	if user, err := user.Current(); err == nil {
+		return path.Join(user.HomeDir, ".local", "state", "awssh")
+	}
+
+	return ""
+}
+
+func loadLastInstance() (*lastInstance, error) {
+	data, err := ioutil.ReadFile(path.Join(getStateDir(), "last.json"))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	last := &lastInstance{}
+
+	if err := json.Unmarshal(data, last); err != nil {
+		return nil, err
+	}
+
+	return last, nil
+}
+
+func saveLastInstance(last *lastInstance) error {
+	dir := getStateDir()
+
+	if dir == "" {
+		return fmt.Errorf("Cannot determine the state directory")
+	}
+
+	data, err := json.Marshal(last)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, "last.json"), data, 0600)
+}
+
+func getCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return path.Join(dir, "awssh")
+	}
+
+	if user, err := user.Current(); err == nil {
+		return path.Join(user.HomeDir, ".cache", "awssh")
+	}
+
+	return ""
+}
+
+func (c *instanceCache) filename(region string, endpoint string, profile string, credentialsFile string, filters []*ec2.Filter) string {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+
+	keyData, _ := json.Marshal(struct {
+		Region          string
+		Endpoint        string
+		Profile         string
+		CredentialsFile string
+		ConfigFile      string
+		Filters         []*ec2.Filter
+	}{region, endpoint, profile, credentialsFile, os.Getenv("AWS_CONFIG_FILE"), filters})
+
+	return path.Join(c.dir, fmt.Sprintf("instances-%x.json", sha256.Sum256(keyData)))
+}
+
+// load returns the cached instances stored in filename, or nil if there are
+// none or they are older than the cache TTL.
+func (c *instanceCache) load(filename string) []map[string]string {
+	if c.refresh {
+		return nil
+	}
+
+	fi, err := os.Stat(filename)
+
+	if err != nil || time.Since(fi.ModTime()) > c.ttl {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil
+	}
+
+	instances := []map[string]string{}
+
+	if err := json.Unmarshal(data, &instances); err != nil {
+		return nil
+	}
+
+	return instances
+}
+
+func (c *instanceCache) store(filename string, instances []map[string]string) error {
+	data, err := json.Marshal(instances)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// awsProfileName returns the name of the AWS profile used when profile is
+// passed to NewSessionWithOptions.
+func awsProfileName(profile string) string {
+	if profile != "" {
+		return profile
+	}
+
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+
+	return "default"
+}
+
+// checkCredentialsFile checks that the credentials file passed with
+// -credentials can be used.
+func checkCredentialsFile(credentialsPath string) error {
+	if _, err := os.Stat(credentialsPath); err != nil {
+		return fmt.Errorf("Cannot use credentials file: %s", err)
+	}
+
+	return nil
+}
+
+// sharedConfigFiles returns the shared configuration files from which the SDK
+// should load the AWS credentials and profiles to use credentialsFile instead
+// of ~/.aws/credentials, or nil to let it find them.
+func sharedConfigFiles(credentialsFile string) []string {
+	if credentialsFile == "" {
+		return nil
+	}
+
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+
+	if configFile == "" {
+		configFile = defaults.SharedConfigFilename()
+	}
+
+	// Same order as the files the SDK loads by default
+	return []string{credentialsFile, configFile}
+}
+
+func newSession(region string, profile string, credentialsFile string) (*session.Session, error) {
+	awsConfig := &aws.Config{Region: aws.String(region)}
+
+	// Enabling the shared config makes the SDK honor the SSO settings of the
+	// profiles in ~/.aws/config
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+		SharedConfigFiles: sharedConfigFiles(credentialsFile),
+	})
+}
+
+// newEC2Client returns an EC2 client for sess, talking to endpoint instead of
+// the standard EC2 endpoint of the region if it's set. The endpoint is not set
+// on the session, as other services (eg. EC2 Instance Connect) don't use it.
+func newEC2Client(sess *session.Session, endpoint string) *ec2.EC2 {
+	awsConfig := &aws.Config{}
+
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+		awsConfig.DisableSSL = aws.Bool(strings.HasPrefix(endpoint, "http://"))
+	}
+
+	return ec2.New(sess, awsConfig)
+}
+
+// stateFilter returns a DescribeInstances filter only matching instances in
+// one of the given states.
+func stateFilter(states []string) *ec2.Filter {
+	filter := &ec2.Filter{Name: aws.String("instance-state-name")}
+
+	for _, state := range states {
+		filter.Values = append(filter.Values, aws.String(state))
+	}
+
+	return filter
+}
+
+// getInstances lists the instances in region matching the given filters.
+func getInstances(logger *runLogger, region string, endpoint string, profile string, credentialsFile string, filters []*ec2.Filter, cache *instanceCache) ([]map[string]string, error) {
+	var cacheFilename string
+
+	if cache != nil {
+		cacheFilename = cache.filename(region, endpoint, awsProfileName(profile), credentialsFile, filters)
+
+		if instances := cache.load(cacheFilename); instances != nil {
+			logger.debugf("Using %d cached instances for region %s from %s", len(instances), region, cacheFilename)
+			return instances, nil
+		}
+	}
+
+	sess, err := newSession(region, profile, credentialsFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	awsec2 := newEC2Client(sess, endpoint)
+	instances := []map[string]string{}
+	var nextToken *string
+
+	for {
+		res, err := awsec2.DescribeInstances(&ec2.DescribeInstancesInput{
+			Filters:   filters,
+			NextToken: nextToken,
+		})
+
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "SSOProviderInvalidToken" {
+			return nil, fmt.Errorf("%s\nThe SSO session has expired, run `aws sso login --profile %s` to start a new one", err, awsProfileName(profile))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range res.Reservations {
+			for _, instance := range reservation.Instances {
+				instances = append(instances, collectInstanceData(instance))
+			}
+		}
+
+		nextToken = res.NextToken
+
+		if res.NextToken == nil {
+			break
+		}
+	}
+
+	logger.debugf("Fetched %d instances in region %s", len(instances), region)
+
+	if cache != nil {
+		if err := cache.store(cacheFilename, instances); err != nil {
+			logger.Printf("Warning: cannot write instance cache: %s", err)
+		}
+	}
+
+	return instances, nil
+}
+
+func rowMatchesExact(row []string, exactMatch string) bool {
+	for _, col := range row {
+		if col == exactMatch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// instanceInSecurityGroup checks whether instance belongs to the security group
+// with the given name or ID.
+func instanceInSecurityGroup(instance map[string]string, group string) bool {
+	groups := append(strings.Split(instance["securityGroupIds"], ","), strings.Split(instance["securityGroups"], ",")...)
+	return rowMatchesExact(groups, group)
+}
+
+// isGlob reports whether filter contains shell-style glob metacharacters.
+func isGlob(filter string) bool {
+	return strings.ContainsAny(filter, "*?[")
+}
+
+// globMatches matches value against a shell-style glob pattern, as
+// implemented by path.Match.
+func globMatches(value string, pattern string) bool {
+	matches, err := path.Match(pattern, value)
+	return err == nil && matches
+}
+
+// rowMatchesGlob checks whether any column of the row matches the shell-style
+// glob pattern.
+func rowMatchesGlob(row []string, pattern string) bool {
+	for _, col := range row {
+		if globMatches(col, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// valueMatchesExact checks whether value equals exactMatch, or matches it if
+// exactMatch is a glob pattern.
+func valueMatchesExact(value string, exactMatch string) bool {
+	if isGlob(exactMatch) && globMatches(value, exactMatch) {
+		return true
+	}
+
+	return value == exactMatch
+}
+
+// findColumn returns the index of the column called name, either in header or
+// by the instance field it displays (eg. "instanceType", or "Name" for the
+// "tag:Name" column). It returns -1 if there is no such column.
+func findColumn(header []string, fields []string, name string) int {
+	for i := range header {
+		if header[i] == name || fields[i] == columnField(name) || fields[i] == "tag:"+name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// parseScopedFilter splits a filter of the form column:term restricting it to
+// one column (see findColumn). The returned index is -1 if the filter does not
+// start with the name of a column, and applies to all columns.
+func parseScopedFilter(filter string, header []string, fields []string) (int, string) {
+	// Try the longest column name first, for filters like tag:Name:web
+	for i := len(filter) - 1; i >= 0; i-- {
+		if filter[i] != ':' {
+			continue
+		}
+
+		if col := findColumn(header, fields, filter[:i]); col != -1 {
+			return col, filter[1+i:]
+		}
+	}
+
+	return -1, filter
+}
+
+func fuzzyMatch(str, match string) bool {
+	if len(match) > len(str) {
+		return false
+	}
+
+	str = strings.ToLower(str)
+	match = strings.ToLower(match)
+
+	i := 0
+	j := 0
+
+	for {
+		if j == len(match) {
+			return true
+		}
+
+		// We've consumed the whole string without consuming the whole match
+		if i == len(str) {
+			return false
+		}
+
+		// Consume a letter from match if possible
+		if match[j] == str[i] {
+			j++
+		}
+
+		// Always consume a letter from str
+		i++
+	}
+}
+
+// rowMatchesFuzzy checks whether each of the given matches fuzzy matches at
+// least one column of the row, or the given column for matches of the form
+// column:term.
+func rowMatchesFuzzy(row []string, header []string, fields []string, matches []string) bool {
+	for _, match := range matches {
+		matched := false
+
+		if col, term := parseScopedFilter(match, header, fields); col != -1 {
+			if !fuzzyMatch(row[col], term) {
+				return false
+			}
+
+			continue
+		}
+
+		for _, col := range row {
+			if fuzzyMatch(col, match) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseExactFilter splits an exact match filter of the form column=value or
+// column:value restricting it to one column (see findColumn). The returned
+// index is -1 if the filter does not start with the name of a column, and
+// applies to all columns (eg. "Env=prod" to match a value of the tags column).
+func parseExactFilter(filter string, header []string, fields []string) (int, string) {
+	if idx := strings.IndexByte(filter, '='); idx != -1 {
+		if col := findColumn(header, fields, filter[:idx]); col != -1 {
+			return col, filter[1+idx:]
+		}
+	}
+
+	return parseScopedFilter(filter, header, fields)
+}
+
+// rowMatches checks whether row matches at least one of the given filters.
+// header holds the name of each column of row, and fields the instance field it
+// displays.
+func rowMatches(row []string, header []string, fields []string, fuzzyMatches []string, exactMatch string) bool {
+	if len(fuzzyMatches) == 0 && exactMatch == "" {
+		return true
+	}
+
+	if exactMatch != "" {
+		col, value := parseExactFilter(exactMatch, header, fields)
+
+		if col != -1 && valueMatchesExact(row[col], value) {
+			return true
+		}
+
+		if col == -1 && isGlob(value) && rowMatchesGlob(row, value) {
+			return true
+		}
+
+		if col == -1 && rowMatchesExact(row, value) {
+			return true
+		}
+	}
+
+	if len(fuzzyMatches) > 0 && rowMatchesFuzzy(row, header, fields, fuzzyMatches) {
+		return true
+	}
+
+	return false
+}
+
+// instanceFilters are the filters an instance must match to be listed.
+type instanceFilters struct {
+	match         []string
+	equal         string
+	securityGroup string
+	vpc           string
+}
+
+// filterInstances returns the instances matching filters, header and fields
+// being the names of the columns of the instance table and the instance fields
+// they display.
+func filterInstances(instances []map[string]string, header []string, fields []string, filters *instanceFilters) []map[string]string {
+	filtered := []map[string]string{}
+
+	for _, instance := range instances {
+		row := make([]string, len(fields))
+
+		for i, field := range fields {
+			row[i] = instance[field]
+		}
+
+		if !rowMatches(row, header, fields, filters.match, filters.equal) {
+			continue
+		}
+
+		if filters.securityGroup != "" && !instanceInSecurityGroup(instance, filters.securityGroup) {
+			continue
+		}
+
+		if filters.vpc != "" && instance["vpcId"] != filters.vpc {
+			continue
+		}
+
+		filtered = append(filtered, instance)
+	}
+
+	return filtered
+}
+
+// newInstanceTable returns the table listing instances, with the given header
+// and fields, preceded by their index if showIndex is set. Rows are colored
+// according to the row-color rules of conf if useColor is set.
+func newInstanceTable(instances []map[string]string, header []string, fields []string, conf *config, style string, useColor bool, showIndex bool) *table {
+	instanceTable := &table{style: style}
+	instanceTable.header = append([]string{}, header...)
+
+	if showIndex {
+		instanceTable.header = append([]string{conf.indexHeader()}, header...)
+	}
+
+	for idx, instance := range instances {
+		row := make([]string, len(fields))
+
+		for i, field := range fields {
+			row[i] = instance[field]
+		}
+
+		color := ""
+
+		if useColor {
+			color = instanceColor(instance, row, header, fields, conf.RowColors)
+		}
+
+		if showIndex {
+			row = append([]string{strconv.Itoa(idx)}, row...)
+		}
+
+		instanceTable.addColoredRow(row, color)
+	}
+
+	return instanceTable
+}
+
+// unknownRuleColumn returns the column named by the row-color rule match if it
+// is neither one of the columns of the table (header and fields) nor a field
+// of the instances, in which case the rule is matched against the values of
+// all the columns. It returns an empty string if the column is known or the
+// rule names no column.
+func unknownRuleColumn(match string, header []string, fields []string) string {
+	known := func(name string) bool {
+		if strings.HasPrefix(name, "tag:") || findColumn(header, fields, name) != -1 {
+			return true
+		}
+
+		for _, field := range instanceFieldNames() {
+			if field == columnField(name) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if idx := strings.IndexByte(match, '='); idx != -1 {
+		if !known(match[:idx]) {
+			return match[:idx]
+		}
+
+		return ""
+	}
+
+	// Values may contain colons, only report a column if none of the
+	// prefixes is known
+	column := ""
+
+	for i := len(match) - 1; i >= 0; i-- {
+		if match[i] != ':' {
+			continue
+		}
+
+		if known(match[:i]) {
+			return ""
+		}
+
+		column = match[:i]
+	}
+
+	return column
+}
+
+// instanceColor returns the ANSI color of the first of rules matched by
+// instance, displayed as row under header and fields, or an empty string if it
+// matches none. Besides the displayed columns, rules can name any other field
+// of the instance (eg. state, or tag:Env).
+func instanceColor(instance map[string]string, row []string, header []string, fields []string, rules []rowColor) string {
+	if len(rules) == 0 {
+		return ""
+	}
+
+	allRow := append([]string{}, row...)
+	allHeader := append([]string{}, header...)
+	allFields := append([]string{}, fields...)
+	others := []string{}
+
+	for field := range instance {
+		if findColumn(header, fields, field) == -1 {
+			others = append(others, field)
+		}
+	}
+
+	sort.Strings(others)
+
+	for _, field := range others {
+		allRow = append(allRow, instance[field])
+		allHeader = append(allHeader, field)
+		allFields = append(allFields, field)
+	}
+
+	for _, rule := range rules {
+		if rowMatches(allRow, allHeader, allFields, nil, rule.Match) {
+			return ansiColors[rule.Color]
+		}
+	}
+
+	return ""
+}
+
+// readline reads a line from r, without the trailing newline. It returns
+// io.EOF if r was closed before anything was read.
+func readline(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// connectByFields maps the possible values of the connect-by configuration
+// option to the instance fields to try, in order, when choosing the address to
+// connect to.
+var connectByFields = map[string][]string{
+	"ip":          {"ipAddress", "privateIpAddress"},
+	"private-ip":  {"privateIpAddress", "ipAddress"},
+	"public-dns":  {"dnsName", "ipAddress", "privateDnsName", "privateIpAddress"},
+	"private-dns": {"privateDnsName", "privateIpAddress", "dnsName", "ipAddress"},
+}
+
+// getInstanceAddress returns the address to connect to instance, or an empty
+// string if it has none (eg. it's terminated).
+func getInstanceAddress(instance map[string]string, connectBy string) string {
+	for _, field := range connectByFields[connectBy] {
+		if address := instance[field]; address != "" {
+			return address
+		}
+	}
+
+	return ""
+}
+
+// checkConnectable verifies that it's possible to connect to instance at
+// address.
+func checkConnectable(instance map[string]string, address string) error {
+	if state := instance["state"]; state != "" && state != ec2.InstanceStateNameRunning {
+		return fmt.Errorf("Cannot connect to instance %s, instance is %s", instance["instanceId"], state)
+	}
+
+	if address == "" {
+		return fmt.Errorf("Cannot determine address for instance %s", instance["instanceId"])
+	}
+
+	return nil
+}
+
+// parseSelection parses the instance indexes typed at the selection prompt. It
+// accepts a single index, or a comma separated list of indexes and ranges (eg.
+// "1,3-5"). All indexes must be lower than count.
+// selectionPattern matches answers to the instance prompt that are indexes
+// (eg. 12, 1,3 or 1-4), as opposed to parts of an address.
+var selectionPattern = regexp.MustCompile(`^[\d\s,-]+$`)
+
+func parseSelection(spec string, count uint64) ([]uint64, error) {
+	selection := []uint64{}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid instance index '%s': %s", item, err)
+		}
+
+		last := first
+
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 64)
+
+			if err != nil {
+				return nil, fmt.Errorf("Invalid instance index '%s': %s", item, err)
+			}
+
+			if last < first {
+				return nil, fmt.Errorf("Invalid instance range '%s': end is before start", item)
+			}
+		}
+
+		if last >= count {
+			return nil, fmt.Errorf("Invalid instance index %d: too large", last)
+		}
+
+		for idx := first; idx <= last; idx++ {
+			selection = append(selection, idx)
+		}
+	}
+
+	return selection, nil
+}
+
+// selectByAddress returns the index of the only instance whose address
+// contains fragment (eg. the last octet of its IP address), as typed at the
+// selection prompt.
+func selectByAddress(fragment string, addresses map[uint64]string) (uint64, error) {
+	matches := []uint64{}
+
+	for idx, address := range addresses {
+		if strings.Contains(address, fragment) {
+			matches = append(matches, idx)
+		}
+	}
+
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("No instance index or address matches '%s'", fragment)
+	}
+
+	if len(matches) > 1 {
+		sort.Slice(matches, func(i, j int) bool { return matches[i] < matches[j] })
+		indexes := make([]string, len(matches))
+
+		for i, idx := range matches {
+			indexes[i] = strconv.FormatUint(idx, 10)
+		}
+
+		return 0, fmt.Errorf("Several instances have an address matching '%s' (%s), be more specific", fragment, strings.Join(indexes, ", "))
+	}
+
+	return matches[0], nil
+}
+
+// newSSHArgs returns the ssh arguments needed to connect to address with key
+// and optionally run command.
+func newSSHArgs(key *sshKey, address string, conf *config, command []string) []string {
+	sshArgs := []string{}
+
+	// Let ssh find the identity itself if we have no key file
+	if key.filename != "" {
+		sshArgs = append(sshArgs, "-i", key.filename)
+	}
+
+	if key.options.JumpHost != "" {
+		sshArgs = append(sshArgs, "-J", key.options.JumpHost)
+	}
+
+	// ssh uses the first value given for an option, so the ones of the key
+	// take precedence over the ones from the configuration
+	sshArgs = append(sshArgs, key.options.ExtraArgs...)
+	sshArgs = append(sshArgs, sshOptions(conf)...)
+	sshArgs = append(sshArgs, key.username+"@"+address)
+
+	if len(command) > 0 {
+		sshArgs = append(sshArgs, strings.Join(command, " "))
+	}
+
+	return sshArgs
+}
+
+// ttyFlag returns the ssh flag controlling the allocation of a pseudo-TTY. A
+// TTY is allocated for interactive sessions, but not when running a command so
+// that its output can be piped, unless forceTTY or noTTY say otherwise.
+func ttyFlag(hasCommand bool, forceTTY bool, noTTY bool) string {
+	if forceTTY {
+		return "-t"
+	}
+
+	if noTTY || hasCommand {
+		return "-T"
+	}
+
+	return "-t"
+}
+
+// sshOptions returns the -o options passed to both ssh and scp.
+func sshOptions(conf *config) []string {
+	if conf.DisableHostKeyCheck != nil && *conf.DisableHostKeyCheck {
+		return []string{"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR"}
+	}
+
+	return nil
+}
+
+// sshOptionNames returns the lowercased names of the options set with -o in
+// args.
+func sshOptionNames(args []string) map[string]bool {
+	names := map[string]bool{}
+
+	for i, arg := range args {
+		option := ""
+
+		if arg == "-o" && i+1 < len(args) {
+			option = args[i+1]
+		} else if strings.HasPrefix(arg, "-o") {
+			option = arg[2:]
+		}
+
+		if option == "" {
+			continue
+		}
+
+		name := strings.FieldsFunc(option, func(r rune) bool { return r == '=' || unicode.IsSpace(r) })
+
+		if len(name) > 0 {
+			names[strings.ToLower(name[0])] = true
+		}
+	}
+
+	return names
+}
+
+// sshDefaultOptions returns the -o options making ssh give up quickly on
+// unreachable instances, and detect dead connections. Options already set in
+// extraArgs are left out.
+func sshDefaultOptions(connectTimeout int, extraArgs []string) []string {
+	defaults := [][2]string{
+		{"ServerAliveInterval", "15"},
+		{"ServerAliveCountMax", "3"},
+	}
+
+	if connectTimeout > 0 {
+		defaults = append([][2]string{{"ConnectTimeout", strconv.Itoa(connectTimeout)}}, defaults...)
+	}
+
+	set := sshOptionNames(extraArgs)
+	options := []string{}
+
+	for _, option := range defaults {
+		if !set[strings.ToLower(option[0])] {
+			options = append(options, "-o", option[0]+"="+option[1])
+		}
+	}
+
+	return options
+}
+
+// sshFlags holds the command line options controlling how ssh connects to an
+// instance.
+type sshFlags struct {
+	connectBy    string
+	forceTTY     bool
+	noTTY        bool
+	forwardAgent bool
+	port         int
+	command      []string
+	keep         bool
+	// connectTimeout is the ConnectTimeout ssh option in seconds, not set if
+	// 0
+	connectTimeout int
+	noDefaults     bool
+}
+
+// buildSSHCommand returns the full ssh command line needed to connect to
+// instance with key, starting with the name of the program as seen by ssh.
+func buildSSHCommand(instance map[string]string, key *sshKey, conf *config, flags *sshFlags) ([]string, error) {
+	address := getInstanceAddress(instance, flags.connectBy)
+
+	if err := checkConnectable(instance, address); err != nil {
+		return nil, err
+	}
+
+	command := flags.command
+
+	// Start a login shell once the command is done, which needs a TTY like
+	// any interactive session
+	if flags.keep && len(command) > 0 {
+		command = []string{strings.Join(command, " ") + "; exec $SHELL -l"}
+	}
+
+	argv := []string{"ssh", ttyFlag(len(command) > 0 && !flags.keep, flags.forceTTY, flags.noTTY)}
+
+	if flags.forwardAgent {
+		argv = append(argv, "-A")
+	}
+
+	port := key.options.Port
+
+	if flags.port != 0 {
+		port = flags.port
+	}
+
+	if port != 0 {
+		argv = append(argv, "-p", strconv.Itoa(port))
+	}
+
+	if !flags.noDefaults {
+		argv = append(argv, sshDefaultOptions(flags.connectTimeout, key.options.ExtraArgs)...)
+	}
+
+	return append(argv, newSSHArgs(key, address, conf, command)...), nil
+}
+
+// checkSCPPaths verifies that paths can be passed to newSCPArgs: there must be
+// at least a source and a destination, and at least one of them must be
+// remote (prefixed with ':').
+func checkSCPPaths(paths []string) error {
+	if len(paths) < 2 {
+		return fmt.Errorf("-scp requires at least a source and a destination path")
+	}
+
+	for _, p := range paths {
+		if strings.HasPrefix(p, ":") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("-scp requires at least one remote path, prefixed with ':'")
+}
+
+// newSCPArgs returns the scp arguments needed to copy files using key, where
+// the paths prefixed with ':' are on the instance at address.
+func newSCPArgs(key *sshKey, address string, conf *config, paths []string) []string {
+	scpArgs := []string{}
+
+	// Let ssh find the identity itself if we have no key file
+	if key.filename != "" {
+		scpArgs = append(scpArgs, "-i", key.filename)
+	}
+
+	if key.options.JumpHost != "" {
+		scpArgs = append(scpArgs, "-J", key.options.JumpHost)
+	}
+
+	scpArgs = append(scpArgs, sshOptions(conf)...)
+
+	for _, p := range paths {
+		if strings.HasPrefix(p, ":") {
+			p = key.username + "@" + address + p
+		}
+
+		scpArgs = append(scpArgs, p)
+	}
+
+	return scpArgs
+}
+
+// prefixWriter writes to w, prefixing each line with prefix.
+type prefixWriter struct {
+	w       io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	buf := bytes.NewBuffer(nil)
+
+	for _, line := range bytes.SplitAfter(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+
+		if !p.midLine {
+			buf.Write(p.prefix)
+		}
+
+		buf.Write(line)
+		p.midLine = line[len(line)-1] != '\n'
+	}
+
+	if _, err := p.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// instanceEnv returns environ with the variables describing the instance ssh
+// connects to added, replacing any previous value they had.
+func instanceEnv(environ []string, instanceID string, address string, region string, keyName string) []string {
+	vars := []string{
+		"AWSSH_INSTANCE_ID=" + instanceID,
+		"AWSSH_IP=" + address,
+		"AWSSH_REGION=" + region,
+		"AWSSH_KEY=" + keyName,
+	}
+
+	env := []string{}
+
+	for _, v := range environ {
+		replaced := false
+
+		for _, newVar := range vars {
+			if strings.HasPrefix(v, newVar[:strings.IndexByte(newVar, '=')+1]) {
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			env = append(env, v)
+		}
+	}
+
+	return append(env, vars...)
+}
+
+// runOnInstance runs ssh with sshArgs and env, prefixing its output with the
+// index of the instance.
+func runOnInstance(logger *runLogger, idx uint64, sshBin string, sshArgs []string, env []string, stdout io.Writer, stderr io.Writer) error {
+	prefix := []byte(fmt.Sprintf("[%d] ", idx))
+	cmd := exec.Command(sshBin, sshArgs...)
+	cmd.Env = env
+	cmd.Stdout = &prefixWriter{w: stdout, prefix: prefix}
+	cmd.Stderr = &prefixWriter{w: stderr, prefix: prefix}
+
+	logger.debugf("Running %s with arguments %q", sshBin, sshArgs)
+
+	return cmd.Run()
+}
+
+// runOnInstancesParallel runs ssh with the given arguments and environment for
+// each instance, running at most jobs commands at the same time. The output
+// and errors of each command are written to stdout and stderr in one go once it
+// has completed, so that the output of different instances does not get mixed.
+// It returns the error of each command.
+func runOnInstancesParallel(logger *runLogger, indexes []uint64, sshBin string, sshArgs [][]string, env [][]string, jobs int, stdout io.Writer, stderr io.Writer) []error {
+	errs := make([]error, len(indexes))
+	slots := make(chan struct{}, jobs)
+	outputLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for i := range indexes {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			output := bytes.NewBuffer(nil)
+			errOutput := bytes.NewBuffer(nil)
+			errs[i] = runOnInstance(logger, indexes[i], sshBin, sshArgs[i], env[i], output, errOutput)
+
+			outputLock.Lock()
+			stdout.Write(output.Bytes())
+			stderr.Write(errOutput.Bytes())
+			outputLock.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// runAndRemove runs the program bin like runChild, and then removes dir.
+func runAndRemove(logger *runLogger, bin string, argv []string, env []string, dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	defer os.RemoveAll(dir)
+
+	return runChild(logger, bin, argv, env, stdin, stdout, stderr)
+}
+
+// runChild runs the program bin with the given argv and environment attached
+// to stdin, stdout and stderr. It returns the exit status of the program.
+func runChild(logger *runLogger, bin string, argv []string, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	cmd := &exec.Cmd{
+		Path:   bin,
+		Args:   argv,
+		Env:    env,
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+
+	// Ctrl-C is for the child process, only catch it for the time it runs so
+	// that handlers registered elsewhere in the process keep working
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+
+	go func() {
+		for range interrupted {
+		}
+	}()
+
+	defer func() {
+		signal.Stop(interrupted)
+		close(interrupted)
+	}()
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+
+		logger.Printf("Cannot spawn %s: %s", bin, err)
+		return 1
+	}
+
+	return 0
+}
+
+var (
+	// errNoAnswer is returned by prompt when the answer is empty, in which
+	// case awssh exits successfully.
+	errNoAnswer = errors.New("No answer")
+	// errClosed is returned by prompt when stdin is closed, eg. when awssh
+	// runs in a script.
+	errClosed = errors.New("Standard input closed")
+	// errInterrupted is returned by prompt when Ctrl-C is pressed, in which
+	// case awssh exits with the conventional status for SIGINT.
+	errInterrupted = errors.New("Interrupted")
+)
+
+// prompt prints message to out and reads the user's answer from in. If Ctrl-C
+// is pressed first, the goroutine reading in is left running until the line is
+// read.
+func prompt(in *bufio.Reader, out io.Writer, message string) (string, error) {
+	fmt.Fprint(out, message)
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+
+	type answer struct {
+		line string
+		err  error
+	}
+
+	answered := make(chan answer, 1)
+
+	go func() {
+		line, err := readline(in)
+		answered <- answer{line, err}
+	}()
+
+	var a answer
+
+	select {
+	case <-interrupted:
+		fmt.Fprintln(out)
+		return "", errInterrupted
+	case a = <-answered:
+	}
+
+	if a.err == io.EOF {
+		fmt.Fprintln(out)
+		return "", errClosed
+	}
+
+	if a.err != nil {
+		return "", fmt.Errorf("Error while reading answer: %s", a.err)
+	}
+
+	if a.line == "" {
+		return "", errNoAnswer
+	}
+
+	return a.line, nil
+}
+
+// promptExitStatus returns the exit status of awssh when prompting failed with
+// err, logging err if it's an actual error.
+func promptExitStatus(logger *runLogger, err error) int {
+	switch err {
+	case errNoAnswer, errClosed:
+		return 0
+	case errInterrupted:
+		return 130
+	}
+
+	return logger.fatalf(1, "%s", err)
+}
+
+// regionPattern matches syntactically valid region names, such as eu-west-1
+// or us-gov-west-1.
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// checkRegion trims whitespace around region and checks that it looks like a
+// region name, to avoid confusing errors from the SDK.
+func checkRegion(region string) (string, error) {
+	region = strings.TrimSpace(region)
+
+	if !regionPattern.MatchString(region) {
+		return "", fmt.Errorf("Invalid region '%s'", region)
+	}
+
+	return region, nil
+}
+
+// listRegions returns the names of the AWS regions enabled for the account,
+// or the static list of known regions if they cannot be fetched.
+func listRegions(logger *runLogger, endpoint string, profile string, credentialsFile string) []string {
+	sess, err := newSession("us-east-1", profile, credentialsFile)
+
+	if err == nil {
+		var res *ec2.DescribeRegionsOutput
+		res, err = newEC2Client(sess, endpoint).DescribeRegions(&ec2.DescribeRegionsInput{})
+
+		if err == nil && len(res.Regions) > 0 {
+			regions := []string{}
+
+			for _, r := range res.Regions {
+				regions = append(regions, aws.StringValue(r.RegionName))
+			}
+
+			sort.Strings(regions)
+
+			return regions
+		}
+	}
+
+	logger.debugf("Cannot list AWS regions, using the list of known regions: %v", err)
+
+	return awsRegions
+}
+
+// promptRegion asks the user to choose one of regions.
+func promptRegion(in *bufio.Reader, out io.Writer, regions []string) (string, error) {
+	regionTable := &table{header: []string{"#", "Region"}}
+
+	for i, r := range regions {
+		regionTable.addRow([]string{strconv.Itoa(i), r})
+	}
+
+	regionTable.render(out)
+	idxStr, err := prompt(in, out, "Region number: ")
+
+	if err != nil {
+		return "", err
+	}
+
+	idx, err := strconv.ParseUint(idxStr, 10, 64)
+
+	if err != nil {
+		return "", fmt.Errorf("Invalid region index '%s': %s", idxStr, err)
+	}
+
+	if idx >= uint64(len(regions)) {
+		return "", fmt.Errorf("Invalid region index %d: too large", idx)
+	}
+
+	return regions[idx], nil
+}
+
+// describeInstance prints all the fields of instance to out, sorted by name.
+func describeInstance(out io.Writer, instance map[string]string, style string) {
+	fieldTable := &table{header: []string{"Field", "Value"}, style: style}
+	fields := []string{}
+
+	for field := range instance {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		fieldTable.addRow([]string{field, instance[field]})
+	}
+
+	fieldTable.render(out)
+}
+
+// matchSummary describes how many instances out of total, listed in one of the
+// given states, matched the given filters.
+func matchSummary(total int, matched int, states []string, matchFilters []string, equalFilter string, region string) string {
+	filters := []string{}
+
+	for _, f := range matchFilters {
+		filters = append(filters, "-m "+f)
+	}
+
+	if equalFilter != "" {
+		filters = append(filters, "-e "+equalFilter)
+	}
+
+	summary := fmt.Sprintf("%d %s instances, %d matched", total, strings.Join(states, " or "), matched)
+
+	if len(filters) > 0 {
+		summary += " (" + strings.Join(filters, " ") + ")"
+	}
+
+	return summary + " in " + region
+}
+
+// Run runs awssh with the command line args (starting with the name of the
+// program, like os.Args), reading answers to its prompts from stdin and
+// writing to stdout and stderr. It returns the exit status of awssh. Connecting
+// to a single instance replaces the current process with ssh (or scp), so Run
+// only returns in that case if it fails to start it.
+//
+// stdin must not be reused once Run returns: answers are read from it through
+// a buffer, and when Ctrl-C is pressed at a prompt (Run then returns 130) a
+// line may still be being read from it.
+func Run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	logger := newRunLogger(stderr)
+
+	if len(args) == 0 {
+		return logger.fatalf(1, "No program name in the command line arguments")
+	}
+
+	in := bufio.NewReader(stdin)
+
+	// Completion scripts only need the flag names, so don't require a valid
+	// configuration to generate them.
+	completion := completionShell(args[1:])
+	logger.verbose = earlyBoolFlag(args[1:], "v", "debug")
+	configPath := earlyStringFlag(args[1:], "config")
+	conf, sshKeys := &config{}, map[string]*sshKey{}
+
+	if completion == "" {
+		var err error
+		conf, sshKeys, err = loadConfig(logger, configPath)
+
+		if err != nil {
+			return logger.fatalf(exitConfigError, "Error while loading configuration: %s", err)
+		}
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.String("config", configPath, "Only load that configuration file (and the keys directory next to it) instead of looking in the standard configuration directories")
+	region := fs.String("r", conf.DefaultRegion, "AWS region to use (set from config if not specified)")
+	matchFilters := stringList{}
+	fs.Var(&matchFilters, "m", `Only list instances that have a column matching the filter.
+The filtering is fuzzy, a column matches if all letters from the filter appear in the column in that order (eg. "thm" matches "thismatches").
+Use the column:filter form to only match a given column (eg. "Name:web" for the tag:Name column).
+Can be passed several times, in which case all filters have to match (not necessarily on the same column).`)
+	equalFilter := fs.String("e", "", `Only list instances that have a column equals to the given value.
+Use the column=value or column:value form to only compare the value of a given column (eg. "instance_type=t3.large").
+The value can be a shell-style glob pattern (eg. "prod-web-*").`)
+	cacheTTL := fs.Duration("cache", 0, "Reuse the instance list fetched from AWS for that long (eg. 30s, disabled by default)")
+	refresh := fs.Bool("refresh", false, "Ignore cached instance lists and fetch them again from AWS")
+	preferPrivate := fs.Bool("private", conf.PreferPrivateIP != nil && *conf.PreferPrivateIP, "Connect to the private IP address of the instance even if it has a public one (set from config if not specified)")
+	fs.BoolVar(&logger.verbose, "v", logger.verbose, "Log debug messages about the configuration, the instances found and the ssh command")
+	fs.BoolVar(&logger.verbose, "debug", logger.verbose, "Same as -v")
+	scp := fs.Bool("scp", false, `Copy files to or from the selected instance with scp instead of connecting to it.
+The paths passed after the options prefixed with ':' are on the instance (eg. "awssh -scp -- local.txt :/tmp/").`)
+	all := fs.Bool("all", false, "Run the command passed after the options on all the instances matching the filters, without prompting")
+	jobs := fs.Int("jobs", 4, "Maximum number of instances on which the command runs at the same time with -all")
+	forceTTY := fs.Bool("force-tty", false, "Always allocate a pseudo-TTY on the instance, even when running a command")
+	noTTY := fs.Bool("no-tty", false, "Never allocate a pseudo-TTY on the instance, even for interactive sessions")
+	connectTimeout := fs.Int("connect-timeout", 10, "Seconds ssh waits for the connection to the instance to be established (0 to use the ssh default)")
+	noSSHDefaults := fs.Bool("no-ssh-defaults", false, "Don't pass the ConnectTimeout, ServerAliveInterval and ServerAliveCountMax options to ssh")
+	keep := fs.Bool("keep", false, "Stay logged in on the instance with an interactive shell once the command passed after the options is done")
+	forwardAgent := fs.Bool("A", false, "Forward the SSH agent connection to the instance")
+	port := fs.Int("p", 0, "Port to connect to on the instance (default from the ssh configuration, usually 22)")
+	eic := fs.Bool("eic", false, "Connect with a temporary SSH key pushed to the instance with EC2 Instance Connect, instead of a key from the keys directory")
+	rdp := fs.Bool("rdp", false, "Connect to the selected Windows instance with an RDP client (xfreerdp, mstsc or open) instead of ssh")
+	showPassword := fs.Bool("show-password", false, "With -rdp, print the Administrator password of the instance for RDP clients to which awssh can't pass it (mstsc and open)")
+	noKey := fs.Bool("no-key", conf.IgnoreKeys != nil && *conf.IgnoreKeys, "Don't pass any key to ssh, letting it choose the identity from its configuration or the SSH agent (set from config if not specified)")
+	loginUser := fs.String("l", "", "User to log in as on the instance, instead of the one from the key file name (default-ssh-user from config with -eic and -no-key, Administrator with -rdp)")
+	tableStyle := fs.String("o", tableStyleBoxed, "Style of the instance table, one of boxed, plain (tab separated values) or markdown")
+	securityGroup := fs.String("sg", "", "Only list instances that belong to the security group with that name or ID")
+	vpc := fs.String("vpc", "", "Only list instances in the VPC with that ID")
+	watch := fs.Duration("watch", 0, "Refresh the list of matching instances at that interval (eg. 10s) until Ctrl-C is pressed, without connecting to any")
+	states := fs.String("state", ec2.InstanceStateNameRunning, "Comma separated list of the states of the instances to list (eg. running,stopped)")
+	noColor := fs.Bool("no-color", false, "Don't color the rows of the instance table (colors are only used when writing to a terminal)")
+	confirm := fs.Bool("confirm", conf.AlwaysConfirm != nil && *conf.AlwaysConfirm, "Prompt for the instance to connect to even if only one matches the filters (set from config if not specified)")
+	noIndex := fs.Bool("no-index", false, "Don't show the index of the instances in the instance table (they can still be selected by index or address)")
+	batch := fs.Bool("batch", false, "Never prompt for an instance, exit with status 3 if several instances match the filters")
+	describe := fs.Bool("describe", false, "Print all the fields of the selected instance instead of connecting to it")
+	regionList := fs.Bool("list-regions", false, "List the available AWS regions and exit")
+	reconnect := fs.Bool("last", false, "Connect to the instance awssh last connected to, if it's still running")
+	credentials := fs.String("credentials", "", "Load the AWS credentials from that file instead of ~/.aws/credentials (set from AWS_SHARED_CREDENTIALS_FILE if not specified)")
+	profile := fs.String("profile", "", "AWS profile to use, including SSO profiles (set from AWS_PROFILE if not specified)")
+	endpoint := fs.String("endpoint", os.Getenv("AWS_ENDPOINT_URL"), "Custom EC2 endpoint URL, eg. for LocalStack (set from AWS_ENDPOINT_URL if not specified)")
+
+	if completion != "" {
+		if err := writeCompletion(stdout, completion, fs); err != nil {
+			return logger.fatalf(1, "Cannot generate completion script: %s", err)
+		}
+
+		return 0
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		// The error and the usage have already been printed. Don't use the
+		// status 2 of flag.ExitOnError, it means that no instance matched.
+		if err == flag.ErrHelp {
+			return 0
+		}
+
+		return 1
+	}
+
+	if *credentials != "" {
+		if err := checkCredentialsFile(*credentials); err != nil {
+			return logger.fatalf(exitConfigError, "%s", err)
+		}
+	}
+
+	var instances []map[string]string
+
+	if *reconnect {
+		last, err := loadLastInstance()
+
+		if err != nil {
+			return logger.fatalf(1, "Error while loading the last connected instance: %s", err)
+		}
+
+		if last == nil {
+			logger.Printf("No last connected instance recorded, listing instances")
+		} else {
+			instances, err = getInstances(logger, last.Region, *endpoint, *profile, *credentials, []*ec2.Filter{
+				stateFilter([]string{ec2.InstanceStateNameRunning}),
+				{
+					Name:   aws.String("instance-id"),
+					Values: []*string{aws.String(last.InstanceID)},
+				},
+			}, nil)
+
+			if err != nil {
+				return logger.fatalf(exitAWSError, "Error while looking up the last connected instance: %s", err)
+			}
+
+			if len(instances) == 0 {
+				logger.Printf("Last connected instance %s is not running anymore, listing instances", last.InstanceID)
+			} else {
+				// Connect straight to the instance, ignoring filters
+				*region = last.Region
+				matchFilters = nil
+				*equalFilter = ""
+			}
+		}
+	}
+
+	if *regionList {
+		for _, r := range listRegions(logger, *endpoint, *profile, *credentials) {
+			fmt.Fprintln(stdout, r)
+		}
+
+		return 0
+	}
+
+	*region = strings.TrimSpace(*region)
+
+	if *region == "" {
+		fmt.Fprintln(stderr, "No region defined, either in the configuration or on the command line.")
+		var err error
+		*region, err = promptRegion(in, stdout, listRegions(logger, *endpoint, *profile, *credentials))
+
+		if err != nil {
+			return promptExitStatus(logger, err)
+		}
+	}
+
+	validRegion, err := checkRegion(*region)
+
+	if err != nil {
+		return logger.fatalf(1, "%s", err)
+	}
+
+	*region = validRegion
+
+	if *forceTTY && *noTTY {
+		return logger.fatalf(1, "-force-tty and -no-tty cannot be used together")
+	}
+
+	if *all && fs.NArg() == 0 {
+		return logger.fatalf(1, "-all requires a command to run")
+	}
+
+	if *scp {
+		if *all {
+			return logger.fatalf(1, "-scp and -all cannot be used together")
+		}
+
+		if err := checkSCPPaths(fs.Args()); err != nil {
+			return logger.fatalf(1, "%s", err)
+		}
+	}
+
+	if *describe && (*all || *scp || *eic) {
+		return logger.fatalf(1, "-describe cannot be used together with -all, -scp or -eic")
+	}
+
+	if *confirm && *batch {
+		return logger.fatalf(1, "-confirm and -batch cannot be used together")
+	}
+
+	if *watch > 0 && (*all || *scp || *eic || *rdp || *describe || *reconnect || fs.NArg() > 0) {
+		return logger.fatalf(1, "-watch cannot be used together with -all, -scp, -eic, -rdp, -describe, -last or a command")
+	}
+
+	if *keep && (*all || *scp || *rdp) {
+		return logger.fatalf(1, "-keep cannot be used together with -all, -scp or -rdp")
+	}
+
+	if *rdp && (*all || *scp || *eic || *describe || fs.NArg() > 0) {
+		return logger.fatalf(1, "-rdp cannot be used together with -all, -scp, -eic, -describe or a command")
+	}
+
+	if *showPassword && !*rdp {
+		return logger.fatalf(1, "-show-password can only be used together with -rdp")
+	}
+
+	if *eic && *noKey {
+		return logger.fatalf(1, "-eic and -no-key cannot be used together")
+	}
+
+	if *eic && (*all || *scp) {
+		return logger.fatalf(1, "-eic cannot be used together with -all or -scp")
+	}
+
+	if *tableStyle != tableStyleBoxed && *tableStyle != tableStylePlain && *tableStyle != tableStyleMarkdown {
+		return logger.fatalf(1, "Invalid table style '%s', must be one of boxed, plain or markdown", *tableStyle)
+	}
+
+	if *jobs < 1 {
+		return logger.fatalf(1, "Invalid number of jobs %d: must be at least 1", *jobs)
+	}
+
+	if *port < 0 || *port > 65535 {
+		return logger.fatalf(1, "Invalid port %d: must be between 1 and 65535", *port)
+	}
+
+	if *connectTimeout < 0 {
+		return logger.fatalf(1, "Invalid connection timeout %d: must be a number of seconds, or 0", *connectTimeout)
+	}
+
+	if len(conf.Columns) == 0 {
+		conf.Columns = defaultColumns
+	}
+
+	connectBy := conf.ConnectBy
+
+	if connectBy == "" {
+		connectBy = "ip"
+	}
+
+	if *preferPrivate {
+		connectBy = "private-ip"
+	}
+
+	if _, ok := connectByFields[connectBy]; !ok {
+		return logger.fatalf(exitConfigError, "Invalid connect-by value '%s', must be one of ip, private-ip, public-dns or private-dns", connectBy)
+	}
+
+	for _, rule := range conf.RowColors {
+		if _, ok := ansiColors[rule.Color]; !ok {
+			return logger.fatalf(exitConfigError, "Invalid row-color color '%s', must be one of black, red, green, yellow, blue, magenta, cyan, white or grey", rule.Color)
+		}
+	}
+
+	useColor := !*noColor && *tableStyle == tableStyleBoxed && isTerminal(stdout)
+
+	header := make([]string, len(conf.Columns))
+	fields := make([]string, len(conf.Columns))
+
+	for i, col := range conf.Columns {
+		header[i] = col.header()
+		fields[i] = columnField(col.Field)
+	}
+
+	for _, rule := range conf.RowColors {
+		if column := unknownRuleColumn(rule.Match, header, fields); column != "" {
+			logger.Printf("Warning: row-color rule '%s' names unknown column '%s', it is compared to the values of all the columns instead", rule.Match, column)
+		}
+	}
+
+	filters := &instanceFilters{
+		match:         matchFilters,
+		equal:         *equalFilter,
+		securityGroup: *securityGroup,
+		vpc:           *vpc,
+	}
+
+	stateNames := strings.Split(*states, ",")
+	apiFilters := []*ec2.Filter{stateFilter(stateNames)}
+
+	if *watch > 0 {
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt)
+		defer signal.Stop(interrupted)
+
+		for {
+			// Never use the cache, the point is to see the changes
+			instances, err := getInstances(logger, *region, *endpoint, *profile, *credentials, apiFilters, nil)
+
+			// Clear the screen and move the cursor to the top left corner
+			fmt.Fprint(stdout, "\x1b[H\x1b[2J")
+			fmt.Fprintf(stdout, "Every %s, last refreshed at %s (Ctrl-C to quit)\n\n", *watch, time.Now().Format("15:04:05"))
+
+			if err != nil {
+				fmt.Fprintf(stderr, "Error while listing EC2 instances: %s\n", err)
+			} else {
+				filtered := filterInstances(instances, header, fields, filters)
+				fmt.Fprintln(stderr, matchSummary(len(instances), len(filtered), stateNames, matchFilters, *equalFilter, *region))
+				newInstanceTable(filtered, header, fields, conf, *tableStyle, useColor, false).render(stdout)
+			}
+
+			select {
+			case <-interrupted:
+				fmt.Fprintln(stdout)
+				return 0
+			case <-time.After(*watch):
+			}
+		}
+	}
+
+	var cache *instanceCache
+
+	if *cacheTTL > 0 {
+		if dir := getCacheDir(); dir != "" {
+			cache = &instanceCache{dir: dir, ttl: *cacheTTL, refresh: *refresh}
+		}
+	}
+
+	if len(instances) == 0 {
+		var err error
+		instances, err = getInstances(logger, *region, *endpoint, *profile, *credentials, apiFilters, cache)
+
+		if err != nil {
+			return logger.fatalf(exitAWSError, "Error while listing EC2 instances: %s", err)
+		}
+	}
+
+	filtered := filterInstances(instances, header, fields, filters)
+	// The index is only useful to pick an instance at the prompt, not in
+	// plain or markdown tables sent to another program or file
+	showIndex := !*noIndex && (*tableStyle == tableStyleBoxed || isTerminal(stdout))
+	instanceTable := newInstanceTable(filtered, header, fields, conf, *tableStyle, useColor, showIndex)
+
+	// Maps (filtered) instance index to instance data
+	instanceData := map[uint64]map[string]string{}
+	// Maps (filtered) instance index to instance ID
+	instanceIDs := map[uint64]string{}
+	// Maps (filtered) instance index to IP address
+	instanceIP := map[uint64]string{}
+	// Maps (filtered) instance index to key name
+	instanceKey := map[uint64]string{}
+
+	for i, instance := range filtered {
+		instanceIndex := uint64(i)
+		instanceData[instanceIndex] = instance
+		instanceIDs[instanceIndex] = instance["instanceId"]
+		instanceIP[instanceIndex] = getInstanceAddress(instance, connectBy)
+		instanceKey[instanceIndex] = conf.keyName(instance)
+	}
+
+	logger.debugf("%d instances out of %d passed the filters", len(instanceTable.rows), len(instances))
+
+	var selected []uint64
+
+	if len(instanceTable.rows) == 0 {
+		fmt.Fprintln(stdout, "No instances matched the given filters in that region.")
+		return exitNoMatch
+	} else if *all {
+		for idx := range instanceTable.rows {
+			selected = append(selected, uint64(idx))
+		}
+	} else if len(instanceTable.rows) == 1 && !*confirm {
+		selected = []uint64{0}
+	} else if *batch {
+		return logger.fatalf(exitAmbiguous, "%d instances matched the given filters, refine them to match only one", len(instanceTable.rows))
+	} else {
+		fmt.Fprintln(stderr, matchSummary(len(instances), len(instanceTable.rows), stateNames, matchFilters, *equalFilter, *region))
+		instanceTable.render(stdout)
+
+		for {
+			idxStr, err := prompt(in, stdout, "Instance number (or part of its address): ")
+
+			if err == errClosed {
+				// Don't let scripts mistake this for success
+				return logger.fatalf(exitAmbiguous, "%d instances matched the given filters and no instance was selected, refine them to match only one", len(instanceTable.rows))
+			}
+
+			if err != nil {
+				return promptExitStatus(logger, err)
+			}
+
+			selected, err = parseSelection(idxStr, uint64(len(instanceTable.rows)))
+
+			if err == nil {
+				break
+			}
+
+			// A mistyped index must not connect to an instance whose address
+			// happens to contain it
+			if selectionPattern.MatchString(idxStr) {
+				fmt.Fprintln(stderr, err)
+				continue
+			}
+
+			// Not an index, try to find the instance by its address
+			idx, err := selectByAddress(idxStr, instanceIP)
+
+			if err == nil {
+				selected = []uint64{idx}
+				break
+			}
+
+			fmt.Fprintln(stderr, err)
+		}
+	}
+
+	if *describe {
+		for _, idx := range selected {
+			describeInstance(stdout, instanceData[idx], *tableStyle)
+		}
+
+		return 0
+	}
+
+	if *all {
+		// Only run the command on the instances we can connect to
+		connectable := []uint64{}
+
+		for _, idx := range selected {
+			if err := checkConnectable(instanceData[idx], instanceIP[idx]); err != nil {
+				logger.Printf("Skipping instance %d: %s", idx, err)
+				continue
+			}
+
+			connectable = append(connectable, idx)
+		}
+
+		if len(connectable) == 0 {
+			return logger.fatalf(exitNoMatch, "None of the instances matching the given filters are running")
+		}
+
+		selected = connectable
+	}
+
+	for _, idx := range selected {
+		if err := checkConnectable(instanceData[idx], instanceIP[idx]); err != nil {
+			return logger.fatalf(1, "%s", err)
+		}
+	}
+
+	if len(selected) > 1 && (fs.NArg() == 0 || *scp || *eic || *keep) {
+		return logger.fatalf(1, "Selecting several instances is only possible when passing a command to run")
+	}
+
+	if *rdp {
+		idx := selected[0]
+		username := *loginUser
+
+		if username == "" {
+			username = rdpUser
+		}
+
+		rdpBin, client, err := findRDPClient()
+
+		if err != nil {
+			return logger.fatalf(1, "%s", err)
+		}
+
+		password := ""
+		// Only xfreerdp can be given the password, don't fetch it for nothing
+		wantPassword := client == "xfreerdp" || *showPassword
+
+		// The password set by EC2 is the one of the Administrator, and is
+		// encrypted with the key of the instance
+		if key := sshKeys[instanceKey[idx]]; key != nil && !*noKey && username == rdpUser && wantPassword {
+			sess, err := newSession(*region, *profile, *credentials)
+
+			if err != nil {
+				return logger.fatalf(exitAWSError, "Error while creating AWS session: %s", err)
+			}
+
+			password, err = getWindowsPassword(newEC2Client(sess, *endpoint), instanceIDs[idx], key.filename)
+
+			if err != nil {
+				logger.Printf("Warning: %s", err)
+			}
+		}
+
+		rdpStdin := stdin
+		passwordFromStdin := password != "" && client == "xfreerdp"
+
+		if passwordFromStdin {
+			// Passing the password on the command line would show it to all
+			// the users of the machine
+			rdpStdin = strings.NewReader(password + "\n")
+		}
+
+		if password != "" && client != "xfreerdp" {
+			fmt.Fprintf(stderr, "Password for %s: %s\n", username, password)
+		}
+
+		argv := rdpArgs(client, username, instanceIP[idx], passwordFromStdin)
+		logger.Printf("Connecting to %s with %s", instanceIP[idx], client)
+
+		return runChild(logger, rdpBin, argv, instanceEnv(os.Environ(), instanceIDs[idx], instanceIP[idx], *region, instanceKey[idx]), rdpStdin, stdout, stderr)
+	}
+
+	keys := make([]*sshKey, len(selected))
+
+	if *eic {
+		username := *loginUser
+
+		if username == "" {
+			username = conf.sshUser()
+		}
+
+		sess, err := newSession(*region, *profile, *credentials)
+
+		if err != nil {
+			return logger.fatalf(exitAWSError, "Error while creating AWS session: %s", err)
+		}
+
+		keys[0], err = pushEphemeralKey(sess, instanceData[selected[0]], username)
+
+		if err != nil {
+			return logger.fatalf(exitAWSError, "%s", err)
+		}
+	}
+
+	for i, idx := range selected {
+		// Already set with -eic
+		if keys[i] != nil {
+			continue
+		}
+
+		keyName := instanceKey[idx]
+		keys[i] = sshKeys[keyName]
+
+		if *noKey {
+			keys[i] = &sshKey{username: conf.sshUser()}
+		}
+
+		if keys[i] == nil {
+			fmt.Fprintf(stderr, `
+I dont have a key called %s. Please create a file called user@%s.pem (or
+%s.pem to log in as %s) in the keys directory of the AWSSH configuration
+directory containing the private SSH key needed to connect to that instance.
+`, keyName, keyName, keyName, conf.sshUser())
+			return exitConfigError
+		}
+
+		if *loginUser != "" {
+			key := *keys[i]
+			key.username = *loginUser
+			keys[i] = &key
+		}
+	}
+
+	if *scp {
+		scpBin, err := exec.LookPath("scp")
+
+		if err != nil {
+			return logger.fatalf(1, "Could not find scp in PATH")
+		}
+
+		scpArgs := []string{"scp"}
+		scpPort := keys[0].options.Port
+
+		if *port != 0 {
+			scpPort = *port
+		}
+
+		if scpPort != 0 {
+			scpArgs = append(scpArgs, "-P", strconv.Itoa(scpPort))
+		}
+
+		if !*noSSHDefaults {
+			scpArgs = append(scpArgs, sshDefaultOptions(*connectTimeout, nil)...)
+		}
+
+		scpArgs = append(scpArgs, newSCPArgs(keys[0], instanceIP[selected[0]], conf, fs.Args())...)
+
+		logger.Printf("Copying files with %s", instanceIP[selected[0]])
+		logger.debugf("Running %s with arguments %q", scpBin, scpArgs)
+
+		if err := syscall.Exec(scpBin, scpArgs, instanceEnv(os.Environ(), instanceIDs[selected[0]], instanceIP[selected[0]], *region, instanceKey[selected[0]])); err != nil {
+			return logger.fatalf(1, "Cannot spawn scp: %s", err)
+		}
+	}
+
+	sshBin, err := exec.LookPath("ssh")
+
+	if err != nil {
+		return logger.fatalf(1, "Could not find ssh in PATH")
+	}
+
+	flags := &sshFlags{
+		connectBy:    connectBy,
+		forceTTY:     *forceTTY,
+		noTTY:        *noTTY,
+		forwardAgent: *forwardAgent,
+		port:         *port,
+		command:      fs.Args(),
+		keep:         *keep,
+
+		connectTimeout: *connectTimeout,
+		noDefaults:     *noSSHDefaults,
+	}
+
+	if *all {
+		sshArgs := make([][]string, len(selected))
+		sshEnv := make([][]string, len(selected))
+
+		for i, idx := range selected {
+			argv, err := buildSSHCommand(instanceData[idx], keys[i], conf, flags)
+
+			if err != nil {
+				return logger.fatalf(1, "%s", err)
+			}
+
+			sshArgs[i] = argv[1:]
+			sshEnv[i] = instanceEnv(os.Environ(), instanceIDs[idx], instanceIP[idx], *region, instanceKey[idx])
+		}
+
+		errs := runOnInstancesParallel(logger, selected, sshBin, sshArgs, sshEnv, *jobs, stdout, stderr)
+		failed := 0
+
+		fmt.Fprintln(stderr, "Summary:")
+
+		for i, idx := range selected {
+			status := "ok"
+
+			if errs[i] != nil {
+				status = "failed: " + errs[i].Error()
+				failed++
+			}
+
+			fmt.Fprintf(stderr, "[%d] %s: %s\n", idx, instanceIP[idx], status)
+		}
+
+		if failed > 0 {
+			fmt.Fprintf(stderr, "Command failed on %d instances out of %d\n", failed, len(selected))
+			return 1
+		}
+
+		return 0
+	}
+
+	if len(selected) > 1 {
+		failed := false
+
+		for i, idx := range selected {
+			argv, err := buildSSHCommand(instanceData[idx], keys[i], conf, flags)
+
+			if err != nil {
+				return logger.fatalf(1, "%s", err)
+			}
+
+			sshEnv := instanceEnv(os.Environ(), instanceIDs[idx], instanceIP[idx], *region, instanceKey[idx])
+
+			if err := runOnInstance(logger, idx, sshBin, argv[1:], sshEnv, stdout, stderr); err != nil {
+				logger.Printf("Command failed on instance %d (%s): %s", idx, instanceIP[idx], err)
+				failed = true
+			}
+		}
+
+		if failed {
+			return 1
+		}
+
+		return 0
+	}
+
+	logger.Printf("Connecting to %s", instanceIP[selected[0]])
+
+	sshArgs, err := buildSSHCommand(instanceData[selected[0]], keys[0], conf, flags)
+
+	if err != nil {
+		return logger.fatalf(1, "%s", err)
+	}
+
+	// ssh needs the environment of the caller, eg. SSH_AUTH_SOCK to use the
+	// SSH agent, TERM and the locale for the terminal, or HOME to find its
+	// configuration
+	sshEnv := instanceEnv(os.Environ(), instanceIDs[selected[0]], instanceIP[selected[0]], *region, instanceKey[selected[0]])
+
+	if err := saveLastInstance(&lastInstance{InstanceID: instanceIDs[selected[0]], Region: *region}); err != nil {
+		logger.debugf("Cannot record the last connected instance: %s", err)
+	}
+
+	logger.debugf("Running %s with arguments %q", sshBin, sshArgs)
+
+	if *eic {
+		// Run ssh as a child process to be able to delete the temporary key
+		// once it is done
+		return runAndRemove(logger, sshBin, sshArgs, sshEnv, path.Dir(keys[0].filename), stdin, stdout, stderr)
+	}
+
+	if err := syscall.Exec(sshBin, sshArgs, sshEnv); err != nil {
+		return logger.fatalf(1, "Cannot spawn ssh: %s", err)
+	}
+
+	// Not reached, syscall.Exec only returns on error
+	return 0
+}
@@ -0,0 +1,1788 @@
+package awssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// setenv sets the environment variable key to value until the test is done.
+func setenv(t *testing.T, key string, value string) {
+	previous, ok := os.LookupEnv(key)
+
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// runAwssh runs awssh with the given arguments and stdin, with a configuration
+// directory containing an empty configuration file and against a fake EC2
+// endpoint listing no instances. If instances is not nil, it is stored in the
+// instance cache and awssh lists it instead. It returns the exit status of
+// awssh and what it printed on stdout and stderr.
+func runAwssh(t *testing.T, stdin string, instances []map[string]string, args ...string) (int, string, string) {
+	configDir, err := ioutil.TempDir("", "awssh-test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(configDir)
+
+	if err := os.Mkdir(path.Join(configDir, "awssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(configDir, "awssh", "config.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ec2Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>test</requestId><reservationSet/></DescribeInstancesResponse>`)
+	}))
+
+	defer ec2Server.Close()
+
+	setenv(t, "AWS_ENDPOINT_URL", ec2Server.URL)
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+	setenv(t, "AWS_EC2_METADATA_DISABLED", "true")
+	setenv(t, "XDG_CACHE_HOME", path.Join(configDir, "cache"))
+	setenv(t, "XDG_STATE_HOME", path.Join(configDir, "state"))
+
+	if instances != nil {
+		cache := &instanceCache{dir: getCacheDir()}
+		filename := cache.filename("eu-west-1", ec2Server.URL, awsProfileName(""), "", []*ec2.Filter{stateFilter([]string{"running"})})
+
+		if err := cache.store(filename, instances); err != nil {
+			t.Fatal(err)
+		}
+
+		args = append([]string{"-cache", "1h"}, args...)
+	}
+
+	args = append([]string{"awssh", "-config", path.Join(configDir, "awssh", "config.json")}, args...)
+
+	var stdout, stderr bytes.Buffer
+	status := Run(args, strings.NewReader(stdin), &stdout, &stderr)
+
+	return status, stdout.String(), stderr.String()
+}
+
+func TestExitStatusNoMatch(t *testing.T) {
+	if status, _, _ := runAwssh(t, "", nil, "-r", "eu-west-1"); status != exitNoMatch {
+		t.Errorf("Unexpected exit status when no instance matches: got %d, expected %d", status, exitNoMatch)
+	}
+
+	// Invalid options must not be mistaken with no instance matching
+	if status, _, _ := runAwssh(t, "", nil, "-bogus", "-r", "eu-west-1"); status != 1 {
+		t.Errorf("Unexpected exit status for an unknown flag: got %d, expected 1", status)
+	}
+}
+
+func TestRunConcurrently(t *testing.T) {
+	missing := path.Join(os.TempDir(), "awssh-test-missing", "config.json")
+	stderr := []bytes.Buffer{{}, {}}
+	done := make(chan int)
+
+	for i := range stderr {
+		go func(i int) {
+			done <- Run([]string{"awssh", "-v", "-config", missing}, strings.NewReader(""), ioutil.Discard, &stderr[i])
+		}(i)
+	}
+
+	for range stderr {
+		if status := <-done; status != exitConfigError {
+			t.Errorf("Unexpected exit status: got %d, expected %d", status, exitConfigError)
+		}
+	}
+
+	// Each run must log to its own stderr
+	for i := range stderr {
+		if !strings.Contains(stderr[i].String(), "Error while loading configuration") {
+			t.Errorf("Missing error on stderr of run %d: %q", i, stderr[i].String())
+		}
+	}
+}
+
+func TestRunOnInstancesParallel(t *testing.T) {
+	// sh stands in for ssh, printing on both stdout and stderr
+	sshArgs := [][]string{
+		{"-c", "echo out 0; echo err 0 >&2"},
+		{"-c", "echo out 1; echo err 1 >&2; exit 1"},
+	}
+
+	var stdout, stderr bytes.Buffer
+	errs := runOnInstancesParallel(newRunLogger(ioutil.Discard), []uint64{0, 1}, "/bin/sh", sshArgs, [][]string{nil, nil}, 2, &stdout, &stderr)
+
+	if errs[0] != nil || errs[1] == nil {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	for _, idx := range []string{"0", "1"} {
+		if !strings.Contains(stdout.String(), "["+idx+"] out "+idx+"\n") || strings.Contains(stdout.String(), "err") {
+			t.Errorf("Unexpected stdout for instance %s: %q", idx, stdout.String())
+		}
+
+		if !strings.Contains(stderr.String(), "["+idx+"] err "+idx+"\n") || strings.Contains(stderr.String(), "out") {
+			t.Errorf("Unexpected stderr for instance %s: %q", idx, stderr.String())
+		}
+	}
+}
+
+func TestRunWithoutArgs(t *testing.T) {
+	var stderr bytes.Buffer
+
+	if status := Run(nil, strings.NewReader(""), ioutil.Discard, &stderr); status != 1 {
+		t.Errorf("Unexpected exit status without arguments: got %d, expected 1", status)
+	}
+
+	if stderr.Len() == 0 {
+		t.Errorf("No error printed without arguments")
+	}
+}
+
+func TestPromptSelection(t *testing.T) {
+	instances := []map[string]string{
+		{"instanceId": "i-1", "ipAddress": "10.0.0.1", "instanceState": "running", "keyName": "key"},
+		{"instanceId": "i-2", "ipAddress": "10.0.0.2", "instanceState": "running", "keyName": "key"},
+	}
+
+	status, stdout, stderr := runAwssh(t, "nope\n1\n", instances, "-describe", "-r", "eu-west-1")
+
+	if status != 0 {
+		t.Errorf("Unexpected exit status: got %d, expected 0 (stderr: %s)", status, stderr)
+	}
+
+	if !strings.Contains(stderr, "No instance index or address matches 'nope'") {
+		t.Errorf("Invalid answer not reported on stderr: %q", stderr)
+	}
+
+	if !strings.Contains(stdout, "Instance number (or part of its address): ") {
+		t.Errorf("No prompt on stdout: %q", stdout)
+	}
+
+	// The description follows the listing, and is the only table with a
+	// Field column
+	if idx := strings.Index(stdout, "Field"); idx == -1 || !strings.Contains(stdout[idx:], "i-2") || strings.Contains(stdout[idx:], "i-1") {
+		t.Errorf("Selected instance not described on stdout: %q", stdout)
+	}
+
+	// 12 is an invalid index, not a part of the address of i-2
+	instances[1]["ipAddress"] = "10.0.0.12"
+	status, stdout, stderr = runAwssh(t, "12\n", instances, "-describe", "-r", "eu-west-1")
+
+	if status != exitAmbiguous || !strings.Contains(stderr, "Invalid instance index 12: too large") || strings.Contains(stdout, "Field") {
+		t.Errorf("Out of range index not rejected: got status %d, stdout %q, stderr %q", status, stdout, stderr)
+	}
+
+	status, stdout, stderr = runAwssh(t, ".12\n", instances, "-describe", "-r", "eu-west-1")
+
+	if status != 0 || !strings.Contains(stdout, "10.0.0.12") || !strings.Contains(stdout, "Field") {
+		t.Errorf("Instance not selected by address: got status %d, stdout %q, stderr %q", status, stdout, stderr)
+	}
+
+	status, _, stderr = runAwssh(t, "\n", instances, "-describe", "-r", "eu-west-1")
+
+	if status != 0 {
+		t.Errorf("Unexpected exit status for an empty answer: got %d, expected 0 (stderr: %s)", status, stderr)
+	}
+
+	status, _, stderr = runAwssh(t, "", instances, "-describe", "-r", "eu-west-1")
+
+	if status != exitAmbiguous {
+		t.Errorf("Unexpected exit status when stdin is closed: got %d, expected %d (stderr: %s)", status, exitAmbiguous, stderr)
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	testData := []struct {
+		Input  string
+		Output string
+	}{
+		{
+			"",
+			"",
+		},
+		{
+			"-",
+			"",
+		},
+		{
+			"---",
+			"",
+		},
+		{
+			"hello-world",
+			"helloWorld",
+		},
+		{
+			"hello-",
+			"hello",
+		},
+		{
+			"-hello",
+			"Hello",
+		},
+		{
+			"a-b-c",
+			"aBC",
+		},
+	}
+
+	for _, d := range testData {
+		cc := camelCase(d.Input)
+
+		if cc != d.Output {
+			t.Errorf("Unexpected output for input '%s': got '%s', expected '%s'", d.Input, cc, d.Output)
+		}
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	testData := []struct {
+		Input   string
+		Match   string
+		Matches bool
+	}{
+		{
+			"",
+			"",
+			true,
+		},
+		{
+			"Hello",
+			"",
+			true,
+		},
+		{
+			"",
+			"match",
+			false,
+		},
+		{
+			"Hello",
+			"Hello",
+			true,
+		},
+		{
+			"Hello",
+			"Hlo",
+			true,
+		},
+		{
+			"HELLO",
+			"hlo",
+			true,
+		},
+	}
+
+	for _, d := range testData {
+		matches := fuzzyMatch(d.Input, d.Match)
+
+		if d.Matches != matches {
+			t.Errorf("Unexpected match result for input '%s' and match '%s': expected %v, got %v", d.Input, d.Match, d.Matches, matches)
+		}
+	}
+}
+
+func TestUnknownConfigKeys(t *testing.T) {
+	testData := []struct {
+		Input   string
+		Unknown []string
+	}{
+		{
+			`{}`,
+			[]string{},
+		},
+		{
+			`{"columns": [], "default-aws-region": "eu-west-1", "disable-host-key-check": true}`,
+			[]string{},
+		},
+		{
+			`{"colums": [], "default-aws-region": "eu-west-1", "foo": 1}`,
+			[]string{"colums", "foo"},
+		},
+	}
+
+	for _, d := range testData {
+		unknown := unknownConfigKeys([]byte(d.Input))
+
+		if !reflect.DeepEqual(unknown, d.Unknown) {
+			t.Errorf("Unexpected unknown keys for input '%s': got %v, expected %v", d.Input, unknown, d.Unknown)
+		}
+	}
+}
+
+func TestVisibleWidth(t *testing.T) {
+	testData := []struct {
+		Input string
+		Width int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"\x1b[31mhello\x1b[0m", 5},
+		{"\x1b[1;90mhé\x1b[0m", 2},
+	}
+
+	for _, d := range testData {
+		if width := visibleWidth(d.Input); width != d.Width {
+			t.Errorf("Unexpected width for %q: got %d, expected %d", d.Input, width, d.Width)
+		}
+	}
+}
+
+func TestGetInstanceAddress(t *testing.T) {
+	instance := map[string]string{
+		"ipAddress":        "1.2.3.4",
+		"privateIpAddress": "10.0.0.1",
+		"dnsName":          "ec2-1-2-3-4.compute.amazonaws.com",
+		"privateDnsName":   "ip-10-0-0-1.internal",
+	}
+
+	privateOnly := map[string]string{
+		"privateIpAddress": "10.0.0.1",
+	}
+
+	publicOnly := map[string]string{
+		"ipAddress": "1.2.3.4",
+	}
+
+	testData := []struct {
+		Instance  map[string]string
+		ConnectBy string
+		Address   string
+	}{
+		{instance, "ip", "1.2.3.4"},
+		{instance, "private-ip", "10.0.0.1"},
+		{instance, "public-dns", "ec2-1-2-3-4.compute.amazonaws.com"},
+		{instance, "private-dns", "ip-10-0-0-1.internal"},
+		{privateOnly, "ip", "10.0.0.1"},
+		{privateOnly, "public-dns", "10.0.0.1"},
+		{publicOnly, "private-ip", "1.2.3.4"},
+		{publicOnly, "private-dns", "1.2.3.4"},
+	}
+
+	for _, d := range testData {
+		address := getInstanceAddress(d.Instance, d.ConnectBy)
+
+		if address != d.Address {
+			t.Errorf("Unexpected address for instance %v (connect by: %s): got '%s', expected '%s'", d.Instance, d.ConnectBy, address, d.Address)
+		}
+	}
+}
+
+func TestCheckRegion(t *testing.T) {
+	testData := []struct {
+		Input  string
+		Region string
+	}{
+		{"eu-west-1", "eu-west-1"},
+		{" eu-west-1 ", "eu-west-1"},
+		{"ap-southeast-4", "ap-southeast-4"},
+		{"us-gov-west-1", "us-gov-west-1"},
+		{"eu-west", ""},
+		{"EU-WEST-1", ""},
+		{"eu west 1", ""},
+		{"", ""},
+	}
+
+	for _, d := range testData {
+		region, err := checkRegion(d.Input)
+
+		if d.Region == "" && err == nil {
+			t.Errorf("Expected an error for region '%s'", d.Input)
+		}
+
+		if d.Region != "" && region != d.Region {
+			t.Errorf("Unexpected region for input '%s': got '%s' (error: %v), expected '%s'", d.Input, region, err, d.Region)
+		}
+	}
+}
+
+func TestRowMatchesExact(t *testing.T) {
+	row := []string{"i-1234", "web-1", "t3.large", "Env=prod"}
+	header := []string{"instance_id", "tag:Name", "instance_type", "tags"}
+	fields := []string{"instanceId", "tag:Name", "instanceType", "tags"}
+
+	testData := []struct {
+		Filter  string
+		Matches bool
+	}{
+		{
+			"t3.large",
+			true,
+		},
+		{
+			"t3",
+			false,
+		},
+		{
+			"instanceType=t3.large",
+			true,
+		},
+		{
+			"instance_type=t3.large",
+			true,
+		},
+		{
+			"tag:Name=web-1",
+			true,
+		},
+		{
+			"Name=web-1",
+			true,
+		},
+		{
+			"instanceId=t3.large",
+			false,
+		},
+		{
+			"instanceType=t3",
+			false,
+		},
+		{
+			"web-*",
+			true,
+		},
+		{
+			"web-?",
+			true,
+		},
+		{
+			"web-??",
+			false,
+		},
+		{
+			"prod-*",
+			false,
+		},
+		{
+			"instanceType=t3.*",
+			true,
+		},
+		{
+			"tag:Name=t3.*",
+			false,
+		},
+		{
+			"t3.larg",
+			false,
+		},
+		{
+			"instance_type:t3.large",
+			true,
+		},
+		{
+			"instanceType:t3.*",
+			true,
+		},
+		{
+			"Name:web-1",
+			true,
+		},
+		{
+			"tag:Name:web-1",
+			true,
+		},
+		{
+			"instance_id:web-1",
+			false,
+		},
+		{
+			"unknown=web-1",
+			false,
+		},
+		{
+			// Env is not a column, this is a value of the tags column
+			"Env=prod",
+			true,
+		},
+	}
+
+	for _, d := range testData {
+		matches := rowMatches(row, header, fields, nil, d.Filter)
+
+		if d.Matches != matches {
+			t.Errorf("Unexpected match result for filter '%s': expected %v, got %v", d.Filter, d.Matches, matches)
+		}
+	}
+}
+
+func TestRowMatchesFuzzy(t *testing.T) {
+	row := []string{"i-1234", "prod-web-1", "t3.large"}
+	header := []string{"instance_id", "tag:Name", "instance_type"}
+	fields := []string{"instanceId", "tag:Name", "instanceType"}
+
+	testData := []struct {
+		Matches []string
+		Result  bool
+	}{
+		{
+			[]string{"web"},
+			true,
+		},
+		{
+			[]string{"prod", "web"},
+			true,
+		},
+		{
+			[]string{"web", "t3"},
+			true,
+		},
+		{
+			[]string{"web", "staging"},
+			false,
+		},
+		{
+			[]string{"Name:web"},
+			true,
+		},
+		{
+			[]string{"tag:Name:pw1"},
+			true,
+		},
+		{
+			[]string{"instance_type:t3"},
+			true,
+		},
+		{
+			[]string{"instance_type:web"},
+			false,
+		},
+		{
+			[]string{"Name:web", "instanceType:large"},
+			true,
+		},
+		{
+			[]string{"Name:t3"},
+			false,
+		},
+	}
+
+	for _, d := range testData {
+		result := rowMatchesFuzzy(row, header, fields, d.Matches)
+
+		if d.Result != result {
+			t.Errorf("Unexpected match result for matches %v: expected %v, got %v", d.Matches, d.Result, result)
+		}
+	}
+}
+
+func TestFilterInstances(t *testing.T) {
+	instances := []map[string]string{
+		{"instanceId": "i-1", "tag:Name": "web-1", "securityGroups": "web", "securityGroupIds": "sg-1", "vpcId": "vpc-1"},
+		{"instanceId": "i-2", "tag:Name": "web-2", "securityGroups": "web,ssh", "securityGroupIds": "sg-1,sg-2", "vpcId": "vpc-2"},
+		{"instanceId": "i-3", "tag:Name": "db-1", "securityGroups": "db", "securityGroupIds": "sg-3", "vpcId": "vpc-1"},
+	}
+
+	fields := []string{"instanceId", "tag:Name"}
+
+	testData := []struct {
+		Filters *instanceFilters
+		IDs     []string
+	}{
+		{&instanceFilters{}, []string{"i-1", "i-2", "i-3"}},
+		{&instanceFilters{match: []string{"web"}}, []string{"i-1", "i-2"}},
+		{&instanceFilters{equal: "db-1"}, []string{"i-3"}},
+		{&instanceFilters{securityGroup: "ssh"}, []string{"i-2"}},
+		{&instanceFilters{securityGroup: "sg-1"}, []string{"i-1", "i-2"}},
+		{&instanceFilters{vpc: "vpc-1"}, []string{"i-1", "i-3"}},
+		{&instanceFilters{match: []string{"web"}, vpc: "vpc-1"}, []string{"i-1"}},
+		{&instanceFilters{vpc: "vpc-3"}, []string{}},
+	}
+
+	for _, d := range testData {
+		ids := []string{}
+
+		for _, instance := range filterInstances(instances, []string{"instanceId", "tag:Name"}, fields, d.Filters) {
+			ids = append(ids, instance["instanceId"])
+		}
+
+		if !reflect.DeepEqual(ids, d.IDs) {
+			t.Errorf("Unexpected instances for filters %+v: got %v, expected %v", *d.Filters, ids, d.IDs)
+		}
+	}
+}
+
+func TestInstanceColor(t *testing.T) {
+	// The rules of the README example, with the default columns
+	rules := []rowColor{
+		{Match: "state=stopped", Color: "grey"},
+		{Match: "tag:Env=prod", Color: "red"},
+	}
+
+	header := []string{"instanceId", "tag:Name", "instanceType", "ipAddress"}
+	fields := []string{"instanceId", "tag:Name", "instanceType", "ipAddress"}
+
+	testData := []struct {
+		Instance map[string]string
+		Color    string
+	}{
+		{
+			map[string]string{"instanceId": "i-1", "state": "stopped", "tag:Env": "prod"},
+			ansiColors["grey"],
+		},
+		{
+			map[string]string{"instanceId": "i-2", "state": "running", "tag:Env": "prod"},
+			ansiColors["red"],
+		},
+		{
+			map[string]string{"instanceId": "i-3", "state": "running", "tag:Env": "dev"},
+			"",
+		},
+	}
+
+	for _, d := range testData {
+		row := make([]string, len(fields))
+
+		for i, field := range fields {
+			row[i] = d.Instance[field]
+		}
+
+		if color := instanceColor(d.Instance, row, header, fields, rules); color != d.Color {
+			t.Errorf("Unexpected color for instance %v: got %q, expected %q", d.Instance, color, d.Color)
+		}
+	}
+
+	// Rules can also name the displayed columns by their header
+	if color := instanceColor(map[string]string{"instanceType": "t3.large"}, []string{"t3.large"}, []string{"Type"}, []string{"instanceType"}, []rowColor{{Match: "Type=t3.*", Color: "blue"}}); color != ansiColors["blue"] {
+		t.Errorf("Unexpected color for a rule naming a column header: got %q", color)
+	}
+}
+
+func TestRenderStyles(t *testing.T) {
+	testData := []struct {
+		Style  string
+		Output string
+	}{
+		{
+			tableStylePlain,
+			"#\tName\n0\ta|b\n1\tcafé\n",
+		},
+		{
+			// Pipes are escaped, columns are at least 3 characters wide for
+			// the header separator, and widths count characters, not bytes
+			tableStyleMarkdown,
+			"| #   | Name |\n| --- | ---- |\n| 0   | a\\|b |\n| 1   | café |\n",
+		},
+	}
+
+	for _, d := range testData {
+		renderTable := &table{header: []string{"#", "Name"}, style: d.Style}
+		renderTable.addRow([]string{"0", "a|b"})
+		renderTable.addRow([]string{"1", "café"})
+
+		var out bytes.Buffer
+		renderTable.render(&out)
+
+		if out.String() != d.Output {
+			t.Errorf("Unexpected %s output: got %q, expected %q", d.Style, out.String(), d.Output)
+		}
+	}
+}
+
+func TestUnknownRuleColumn(t *testing.T) {
+	header := []string{"instanceId", "Type"}
+	fields := []string{"instanceId", "instanceType"}
+
+	testData := []struct {
+		Match  string
+		Column string
+	}{
+		{"state=stopped", ""},
+		{"Type=t3.large", ""},
+		{"instance_type=t3.large", ""},
+		{"tag:Env=prod", ""},
+		{"tag:Env:prod", ""},
+		{"stopped", ""},
+		{"stat=stopped", "stat"},
+		{"stat:stopped", "stat"},
+	}
+
+	for _, d := range testData {
+		if column := unknownRuleColumn(d.Match, header, fields); column != d.Column {
+			t.Errorf("Unexpected unknown column for rule '%s': got '%s', expected '%s'", d.Match, column, d.Column)
+		}
+	}
+}
+
+func TestNewInstanceTable(t *testing.T) {
+	instances := []map[string]string{
+		{"instanceId": "i-1", "tag:Name": "web-1"},
+		{"instanceId": "i-2", "tag:Name": "web-2"},
+	}
+
+	header := []string{"instance_id", "tag:Name"}
+	fields := []string{"instanceId", "tag:Name"}
+
+	testData := []struct {
+		Conf      *config
+		ShowIndex bool
+		Header    []string
+		Rows      [][]string
+	}{
+		{
+			&config{},
+			true,
+			[]string{"#", "instance_id", "tag:Name"},
+			[][]string{{"0", "i-1", "web-1"}, {"1", "i-2", "web-2"}},
+		},
+		{
+			&config{IndexHeader: "idx"},
+			true,
+			[]string{"idx", "instance_id", "tag:Name"},
+			[][]string{{"0", "i-1", "web-1"}, {"1", "i-2", "web-2"}},
+		},
+		{
+			&config{},
+			false,
+			[]string{"instance_id", "tag:Name"},
+			[][]string{{"i-1", "web-1"}, {"i-2", "web-2"}},
+		},
+	}
+
+	for _, d := range testData {
+		instanceTable := newInstanceTable(instances, header, fields, d.Conf, tableStylePlain, false, d.ShowIndex)
+
+		if !reflect.DeepEqual(instanceTable.header, d.Header) {
+			t.Errorf("Unexpected header: got %q, expected %q", instanceTable.header, d.Header)
+		}
+
+		if !reflect.DeepEqual(instanceTable.rows, d.Rows) {
+			t.Errorf("Unexpected rows: got %q, expected %q", instanceTable.rows, d.Rows)
+		}
+	}
+}
+
+func TestEarlyBoolFlag(t *testing.T) {
+	testData := []struct {
+		Args []string
+		Set  bool
+	}{
+		{
+			[]string{},
+			false,
+		},
+		{
+			[]string{"-v"},
+			true,
+		},
+		{
+			[]string{"-r", "eu-west-1", "--debug"},
+			true,
+		},
+		{
+			[]string{"-v=false"},
+			false,
+		},
+		{
+			[]string{"--", "-v"},
+			false,
+		},
+		{
+			// -v is an option of the command to run on the instance
+			[]string{"-m", "web", "ls", "-v"},
+			false,
+		},
+		{
+			// -v is the value of -m
+			[]string{"-m", "-v"},
+			false,
+		},
+	}
+
+	for _, d := range testData {
+		set := earlyBoolFlag(d.Args, "v", "debug")
+
+		if set != d.Set {
+			t.Errorf("Unexpected result for args %v: got %v, expected %v", d.Args, set, d.Set)
+		}
+	}
+}
+
+func TestEarlyStringFlag(t *testing.T) {
+	testData := []struct {
+		Args  []string
+		Value string
+	}{
+		{
+			[]string{},
+			"",
+		},
+		{
+			[]string{"-config", "a.json"},
+			"a.json",
+		},
+		{
+			[]string{"-v", "--config=a.json"},
+			"a.json",
+		},
+		{
+			[]string{"-config"},
+			"",
+		},
+		{
+			[]string{"-m", "web", "cat", "-config", "a.json"},
+			"",
+		},
+		{
+			[]string{"-e", "-config", "-r", "eu-west-1"},
+			"",
+		},
+		{
+			[]string{"--", "-config", "a.json"},
+			"",
+		},
+	}
+
+	for _, d := range testData {
+		value := earlyStringFlag(d.Args, "config")
+
+		if value != d.Value {
+			t.Errorf("Unexpected value for args %v: got '%s', expected '%s'", d.Args, value, d.Value)
+		}
+	}
+}
+
+func TestEarlyValueFlags(t *testing.T) {
+	// The usage lists the flags taking a value with the name of their type
+	// (eg. "-r string")
+	_, _, stderr := runAwssh(t, "", nil, "-h")
+	usageFlag := regexp.MustCompile(`^  -(\S+)( \S+)?$`)
+	valueFlags := map[string]bool{"completion": true}
+
+	for _, line := range strings.Split(stderr, "\n") {
+		if m := usageFlag.FindStringSubmatch(line); m != nil && m[2] != "" {
+			valueFlags[m[1]] = true
+		}
+	}
+
+	if !reflect.DeepEqual(valueFlags, earlyValueFlags) {
+		t.Errorf("earlyValueFlags doesn't list the flags taking a value: got %v, expected %v", earlyValueFlags, valueFlags)
+	}
+}
+
+func TestCheckConnectable(t *testing.T) {
+	testData := []struct {
+		Instance    map[string]string
+		Address     string
+		Connectable bool
+	}{
+		{map[string]string{"instanceId": "i-1", "state": "running"}, "1.2.3.4", true},
+		{map[string]string{"instanceId": "i-1", "state": "running"}, "", false},
+		{map[string]string{"instanceId": "i-1", "state": "stopped"}, "10.0.0.1", false},
+		{map[string]string{"instanceId": "i-1", "state": "terminated"}, "", false},
+	}
+
+	for _, d := range testData {
+		err := checkConnectable(d.Instance, d.Address)
+
+		if (err == nil) != d.Connectable {
+			t.Errorf("Unexpected result for instance %v with address '%s': got error %v, expected connectable: %v", d.Instance, d.Address, err, d.Connectable)
+		}
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	testData := []struct {
+		Input     string
+		Selection []uint64
+	}{
+		{
+			"2",
+			[]uint64{2},
+		},
+		{
+			"1,3,5",
+			[]uint64{1, 3, 5},
+		},
+		{
+			"1-4",
+			[]uint64{1, 2, 3, 4},
+		},
+		{
+			"0, 2-3,5",
+			[]uint64{0, 2, 3, 5},
+		},
+		{
+			"abc",
+			nil,
+		},
+		{
+			"3-1",
+			nil,
+		},
+		{
+			"6",
+			nil,
+		},
+		{
+			"4-6",
+			nil,
+		},
+	}
+
+	for _, d := range testData {
+		selection, err := parseSelection(d.Input, 6)
+
+		if d.Selection == nil && err == nil {
+			t.Errorf("Expected an error for input '%s', got selection %v", d.Input, selection)
+		}
+
+		if d.Selection != nil && !reflect.DeepEqual(selection, d.Selection) {
+			t.Errorf("Unexpected selection for input '%s': got %v (error: %v), expected %v", d.Input, selection, err, d.Selection)
+		}
+	}
+}
+
+func TestSelectByAddress(t *testing.T) {
+	addresses := map[uint64]string{
+		0: "10.0.1.12",
+		1: "10.0.1.34",
+		2: "10.0.2.34",
+	}
+
+	testData := []struct {
+		Fragment string
+		Index    uint64
+		Error    bool
+	}{
+		{".12", 0, false},
+		{"1.34", 1, false},
+		{"10.0.2", 2, false},
+		{".34", 0, true},
+		{"10.0", 0, true},
+		{"192.168", 0, true},
+	}
+
+	for _, d := range testData {
+		idx, err := selectByAddress(d.Fragment, addresses)
+
+		if d.Error && err == nil {
+			t.Errorf("Expected an error for fragment '%s', got index %d", d.Fragment, idx)
+		}
+
+		if !d.Error && (err != nil || idx != d.Index) {
+			t.Errorf("Unexpected index for fragment '%s': got %d (error: %v), expected %d", d.Fragment, idx, err, d.Index)
+		}
+	}
+}
+
+func TestInstanceEnv(t *testing.T) {
+	environ := []string{"HOME=/home/user", "AWSSH_IP=5.6.7.8", "TERM=xterm"}
+	expected := []string{
+		"HOME=/home/user",
+		"TERM=xterm",
+		"AWSSH_INSTANCE_ID=i-1234",
+		"AWSSH_IP=1.2.3.4",
+		"AWSSH_REGION=eu-west-1",
+		"AWSSH_KEY=prod",
+	}
+
+	if env := instanceEnv(environ, "i-1234", "1.2.3.4", "eu-west-1", "prod"); !reflect.DeepEqual(env, expected) {
+		t.Errorf("Unexpected environment: got %q, expected %q", env, expected)
+	}
+}
+
+func TestInstanceEnvKeepsEnvironment(t *testing.T) {
+	environ := os.Environ()
+	env := map[string]bool{}
+
+	for _, v := range instanceEnv(environ, "i-1234", "1.2.3.4", "eu-west-1", "prod") {
+		env[v] = true
+	}
+
+	// ssh must see the whole environment of awssh (SSH_AUTH_SOCK, TERM...)
+	for _, v := range environ {
+		if !strings.HasPrefix(v, "AWSSH_") && !env[v] {
+			t.Errorf("Variable %s of the environment is not passed to ssh", v)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := &prefixWriter{w: buf, prefix: []byte("[1] ")}
+
+	for _, chunk := range []string{"hello\nwor", "ld\n", "\nbye"} {
+		w.Write([]byte(chunk))
+	}
+
+	expected := "[1] hello\n[1] world\n[1] \n[1] bye"
+
+	if buf.String() != expected {
+		t.Errorf("Unexpected output: got %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestNewSSHArgs(t *testing.T) {
+	key := &sshKey{username: "ec2-user", filename: "/keys/ec2-user@key.pem"}
+	disableHostKeyCheck := true
+	enableHostKeyCheck := false
+
+	testData := []struct {
+		Conf    *config
+		Command []string
+		Args    []string
+	}{
+		{
+			&config{},
+			nil,
+			[]string{"-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4"},
+		},
+		{
+			&config{DisableHostKeyCheck: &enableHostKeyCheck},
+			[]string{"tail", "-f", "/var/log/messages"},
+			[]string{"-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4", "tail -f /var/log/messages"},
+		},
+		{
+			&config{DisableHostKeyCheck: &disableHostKeyCheck},
+			nil,
+			[]string{"-i", "/keys/ec2-user@key.pem", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR", "ec2-user@1.2.3.4"},
+		},
+	}
+
+	for _, d := range testData {
+		args := newSSHArgs(key, "1.2.3.4", d.Conf, d.Command)
+
+		if !reflect.DeepEqual(args, d.Args) {
+			t.Errorf("Unexpected ssh arguments for command %v: got %q, expected %q", d.Command, args, d.Args)
+		}
+	}
+
+	// Without key file, ssh chooses the identity
+	args := newSSHArgs(&sshKey{username: "ec2-user"}, "1.2.3.4", &config{}, nil)
+
+	if expected := []string{"ec2-user@1.2.3.4"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Unexpected ssh arguments without key file: got %q, expected %q", args, expected)
+	}
+}
+
+func TestBuildSSHCommand(t *testing.T) {
+	key := &sshKey{username: "ec2-user", filename: "/keys/ec2-user@key.pem"}
+	instance := map[string]string{"instanceId": "i-1234", "ipAddress": "1.2.3.4", "privateIpAddress": "10.0.0.1", "state": "running"}
+	stopped := map[string]string{"instanceId": "i-5678", "privateIpAddress": "10.0.0.2", "state": "stopped"}
+	disableHostKeyCheck := true
+
+	testData := []struct {
+		Instance map[string]string
+		Conf     *config
+		Flags    *sshFlags
+		Argv     []string
+	}{
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true},
+			[]string{"ssh", "-t", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "private-ip", noDefaults: true},
+			[]string{"ssh", "-t", "-i", "/keys/ec2-user@key.pem", "ec2-user@10.0.0.1"},
+		},
+		{
+			instance,
+			&config{DisableHostKeyCheck: &disableHostKeyCheck},
+			&sshFlags{connectBy: "ip", noDefaults: true},
+			[]string{"ssh", "-t", "-i", "/keys/ec2-user@key.pem", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR", "ec2-user@1.2.3.4"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true, forwardAgent: true},
+			[]string{"ssh", "-t", "-A", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true, port: 2222},
+			[]string{"ssh", "-t", "-p", "2222", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true, command: []string{"tail", "-f", "/var/log/messages"}},
+			[]string{"ssh", "-T", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4", "tail -f /var/log/messages"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true, forceTTY: true, command: []string{"top"}},
+			[]string{"ssh", "-t", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4", "top"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true, keep: true, command: []string{"tail", "/var/log/messages"}},
+			[]string{"ssh", "-t", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4", "tail /var/log/messages; exec $SHELL -l"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true, keep: true},
+			[]string{"ssh", "-t", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip", connectTimeout: 10},
+			[]string{"ssh", "-t", "-o", "ConnectTimeout=10", "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4"},
+		},
+		{
+			instance,
+			&config{},
+			&sshFlags{connectBy: "ip"},
+			[]string{"ssh", "-t", "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3", "-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4"},
+		},
+		{
+			stopped,
+			&config{},
+			&sshFlags{connectBy: "ip", noDefaults: true},
+			nil,
+		},
+	}
+
+	for _, d := range testData {
+		argv, err := buildSSHCommand(d.Instance, key, d.Conf, d.Flags)
+
+		if d.Argv == nil && err == nil {
+			t.Errorf("Expected an error for instance %v", d.Instance)
+		}
+
+		if d.Argv != nil && !reflect.DeepEqual(argv, d.Argv) {
+			t.Errorf("Unexpected ssh command for flags %+v: got %q (error: %v), expected %q", *d.Flags, argv, err, d.Argv)
+		}
+	}
+}
+
+func TestSSHDefaultOptions(t *testing.T) {
+	key := &sshKey{
+		username: "ec2-user",
+		filename: "/keys/ec2-user@key.pem",
+		options:  keyOptions{ExtraArgs: []string{"-o", "ConnectTimeout=30", "-oserveraliveinterval 60"}},
+	}
+
+	instance := map[string]string{"instanceId": "i-1234", "ipAddress": "1.2.3.4"}
+	argv, err := buildSSHCommand(instance, key, &config{}, &sshFlags{connectBy: "ip", connectTimeout: 10})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := map[string]int{}
+
+	for i, arg := range argv {
+		if arg == "-o" {
+			count[strings.SplitN(argv[i+1], "=", 2)[0]]++
+		}
+	}
+
+	expected := map[string]int{"ConnectTimeout": 1, "ServerAliveCountMax": 1}
+
+	if !reflect.DeepEqual(count, expected) {
+		t.Errorf("Unexpected options in %q: got %v, expected %v", argv, count, expected)
+	}
+
+	expectedArgv := []string{"ssh", "-t", "-o", "ServerAliveCountMax=3", "-i", "/keys/ec2-user@key.pem", "-o", "ConnectTimeout=30", "-oserveraliveinterval 60", "ec2-user@1.2.3.4"}
+
+	if !reflect.DeepEqual(argv, expectedArgv) {
+		t.Errorf("Unexpected ssh command: got %q, expected %q", argv, expectedArgv)
+	}
+}
+
+func TestNewSCPArgs(t *testing.T) {
+	key := &sshKey{username: "ec2-user", filename: "/keys/ec2-user@key.pem"}
+	disableHostKeyCheck := true
+
+	testData := []struct {
+		Conf  *config
+		Paths []string
+		Args  []string
+	}{
+		{
+			&config{},
+			[]string{"local.txt", ":/tmp/"},
+			[]string{"-i", "/keys/ec2-user@key.pem", "local.txt", "ec2-user@1.2.3.4:/tmp/"},
+		},
+		{
+			&config{},
+			[]string{":/var/log/messages", "."},
+			[]string{"-i", "/keys/ec2-user@key.pem", "ec2-user@1.2.3.4:/var/log/messages", "."},
+		},
+		{
+			&config{DisableHostKeyCheck: &disableHostKeyCheck},
+			[]string{"local.txt", ":"},
+			[]string{"-i", "/keys/ec2-user@key.pem", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR", "local.txt", "ec2-user@1.2.3.4:"},
+		},
+	}
+
+	for _, d := range testData {
+		args := newSCPArgs(key, "1.2.3.4", d.Conf, d.Paths)
+
+		if !reflect.DeepEqual(args, d.Args) {
+			t.Errorf("Unexpected scp arguments for paths %v: got %q, expected %q", d.Paths, args, d.Args)
+		}
+	}
+}
+
+func TestTTYFlag(t *testing.T) {
+	testData := []struct {
+		HasCommand bool
+		ForceTTY   bool
+		NoTTY      bool
+		Flag       string
+	}{
+		{false, false, false, "-t"},
+		{true, false, false, "-T"},
+		{true, true, false, "-t"},
+		{false, false, true, "-T"},
+	}
+
+	for _, d := range testData {
+		flag := ttyFlag(d.HasCommand, d.ForceTTY, d.NoTTY)
+
+		if flag != d.Flag {
+			t.Errorf("Unexpected TTY flag (command: %v, force: %v, disable: %v): got %s, expected %s", d.HasCommand, d.ForceTTY, d.NoTTY, flag, d.Flag)
+		}
+	}
+}
+
+func TestSSHPublicKey(t *testing.T) {
+	pub := &rsa.PublicKey{E: 65537, N: big.NewInt(0xc0ffee)}
+	expected := "ssh-rsa " + base64.StdEncoding.EncodeToString([]byte(
+		"\x00\x00\x00\x07ssh-rsa"+
+			"\x00\x00\x00\x03\x01\x00\x01"+
+			"\x00\x00\x00\x04\x00\xc0\xff\xee"))
+
+	if key := sshPublicKey(pub); key != expected {
+		t.Errorf("Unexpected public key: got %s, expected %s", key, expected)
+	}
+}
+
+func TestRDPArgs(t *testing.T) {
+	testData := []struct {
+		Client            string
+		PasswordFromStdin bool
+		Args              []string
+	}{
+		{"xfreerdp", false, []string{"xfreerdp", "/v:1.2.3.4", "/u:Administrator"}},
+		{"xfreerdp", true, []string{"xfreerdp", "/v:1.2.3.4", "/u:Administrator", "/d:", "/from-stdin"}},
+		{"mstsc", true, []string{"mstsc", "/v:1.2.3.4"}},
+		{"open", true, []string{"open", "rdp://full%20address=s:1.2.3.4&username=s:Administrator"}},
+	}
+
+	for _, d := range testData {
+		args := rdpArgs(d.Client, "Administrator", "1.2.3.4", d.PasswordFromStdin)
+
+		if !reflect.DeepEqual(args, d.Args) {
+			t.Errorf("Unexpected arguments for client %s: got %q, expected %q", d.Client, args, d.Args)
+		}
+	}
+}
+
+func TestDecryptWindowsPassword(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, &privateKey.PublicKey, []byte("s3cr3t"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyData := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	password, err := decryptWindowsPassword(base64.StdEncoding.EncodeToString(encrypted), keyData)
+
+	if err != nil || password != "s3cr3t" {
+		t.Errorf("Unexpected password: got '%s' (error: %v), expected 's3cr3t'", password, err)
+	}
+
+	if _, err := decryptWindowsPassword("not base64!", keyData); err == nil {
+		t.Errorf("Expected an error for invalid password data")
+	}
+
+	if _, err := decryptWindowsPassword(base64.StdEncoding.EncodeToString(encrypted), []byte("not a key")); err == nil {
+		t.Errorf("Expected an error for an invalid key")
+	}
+}
+
+func TestColumnUnmarshal(t *testing.T) {
+	testData := []struct {
+		Input   string
+		Columns []column
+		Headers []string
+	}{
+		{
+			`["instance_type", "tag:Name"]`,
+			[]column{{Field: "instance_type"}, {Field: "tag:Name"}},
+			[]string{"instance_type", "tag:Name"},
+		},
+		{
+			`["instanceType=Type", "tag:Name=Name"]`,
+			[]column{{Field: "instanceType", Header: "Type"}, {Field: "tag:Name", Header: "Name"}},
+			[]string{"Type", "Name"},
+		},
+		{
+			`[{"field": "tag:Name", "header": "Name"}, {"field": "ipAddress"}]`,
+			[]column{{Field: "tag:Name", Header: "Name"}, {Field: "ipAddress"}},
+			[]string{"Name", "ipAddress"},
+		},
+	}
+
+	for _, d := range testData {
+		columns := []column{}
+
+		if err := json.Unmarshal([]byte(d.Input), &columns); err != nil {
+			t.Errorf("Error while parsing columns %s: %s", d.Input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(columns, d.Columns) {
+			t.Errorf("Unexpected columns for %s: got %+v, expected %+v", d.Input, columns, d.Columns)
+		}
+
+		headers := []string{}
+
+		for _, col := range columns {
+			headers = append(headers, col.header())
+		}
+
+		if !reflect.DeepEqual(headers, d.Headers) {
+			t.Errorf("Unexpected headers for %s: got %q, expected %q", d.Input, headers, d.Headers)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`[42]`), &[]column{}); err == nil {
+		t.Errorf("Expected an error for an invalid column")
+	}
+}
+
+func TestLoadConfigFromExplicitPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awssh-test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	configPath := path.Join(dir, "test.json")
+
+	if err := ioutil.WriteFile(configPath, []byte(`{"default-aws-region": "eu-west-1", "default-ssh-user": "admin"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(path.Join(dir, "keys"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"ubuntu@prod.pem", "staging.pem"} {
+		if err := ioutil.WriteFile(path.Join(dir, "keys", name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf, keys, err := loadConfig(newRunLogger(ioutil.Discard), configPath)
+
+	if err != nil {
+		t.Fatalf("Error while loading configuration: %s", err)
+	}
+
+	if conf.DefaultRegion != "eu-west-1" {
+		t.Errorf("Unexpected default region: got '%s', expected 'eu-west-1'", conf.DefaultRegion)
+	}
+
+	expectedKeys := map[string]*sshKey{
+		"prod":    {username: "ubuntu", filename: path.Join(dir, "keys", "ubuntu@prod.pem")},
+		"staging": {username: "admin", filename: path.Join(dir, "keys", "staging.pem")},
+	}
+
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Unexpected keys: got %v, expected %v", keys, expectedKeys)
+	}
+
+	if _, _, err := loadConfig(newRunLogger(ioutil.Discard), path.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Expected an error when loading a missing configuration file")
+	}
+}
+
+func TestCheckCredentialsFile(t *testing.T) {
+	credentials, err := ioutil.TempFile("", "awssh-test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials.Close()
+	defer os.Remove(credentials.Name())
+
+	if err := checkCredentialsFile(credentials.Name()); err != nil {
+		t.Errorf("Error while checking credentials file: %s", err)
+	}
+
+	if err := checkCredentialsFile(credentials.Name() + ".missing"); err == nil {
+		t.Errorf("Expected an error for a missing credentials file")
+	}
+}
+
+func TestSharedConfigFiles(t *testing.T) {
+	setenv(t, "AWS_CONFIG_FILE", "/tmp/aws-config")
+
+	if files := sharedConfigFiles(""); files != nil {
+		t.Errorf("Unexpected shared config files without credentials file: %v", files)
+	}
+
+	expected := []string{"/tmp/aws-credentials", "/tmp/aws-config"}
+
+	if files := sharedConfigFiles("/tmp/aws-credentials"); !reflect.DeepEqual(files, expected) {
+		t.Errorf("Unexpected shared config files: got %v, expected %v", files, expected)
+	}
+}
+
+func TestParseKeySpec(t *testing.T) {
+	testData := []struct {
+		Spec     string
+		Username string
+		KeyName  string
+	}{
+		{
+			"ec2-user@my_key",
+			"ec2-user",
+			"my_key",
+		},
+		{
+			"my_key",
+			"",
+			"my_key",
+		},
+		{
+			"ubuntu@user@key",
+			"ubuntu",
+			"user@key",
+		},
+	}
+
+	for _, d := range testData {
+		username, keyName := parseKeySpec(d.Spec)
+
+		if username != d.Username || keyName != d.KeyName {
+			t.Errorf("Unexpected result for spec '%s': got ('%s', '%s'), expected ('%s', '%s')", d.Spec, username, keyName, d.Username, d.KeyName)
+		}
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	tagged := map[string]string{"keyName": "aws-key", "tag:SSHKey": "team-key"}
+	untagged := map[string]string{"keyName": "aws-key"}
+
+	testData := []struct {
+		KeyFromTag string
+		Instance   map[string]string
+		KeyName    string
+	}{
+		{"", tagged, "aws-key"},
+		{"SSHKey", tagged, "team-key"},
+		{"SSHKey", untagged, "aws-key"},
+		{"Other", tagged, "aws-key"},
+	}
+
+	for _, d := range testData {
+		conf := &config{KeyFromTag: d.KeyFromTag}
+
+		if keyName := conf.keyName(d.Instance); keyName != d.KeyName {
+			t.Errorf("Unexpected key name for instance %v with key-from-tag '%s': got '%s', expected '%s'", d.Instance, d.KeyFromTag, keyName, d.KeyName)
+		}
+	}
+}
+
+func TestLoadSshKeysFromDirCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awssh-test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"ubuntu@prod.pem", "root@prod.pem", "ec2-user@staging.pem"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var log bytes.Buffer
+	keys, err := loadSshKeysFromDir(newRunLogger(&log), dir)
+
+	if err != nil {
+		t.Fatalf("Error while loading keys: %s", err)
+	}
+
+	if len(keys) != 2 {
+		t.Errorf("Unexpected number of keys: got %d, expected 2", len(keys))
+	}
+
+	if key := keys["prod"]; key == nil || key.username != "root" {
+		t.Errorf("Unexpected key for prod: got %v, expected the one from root@prod.pem", key)
+	}
+
+	if key := keys["staging"]; key == nil || key.username != "ec2-user" {
+		t.Errorf("Unexpected key for staging: got %v, expected the one from ec2-user@staging.pem", key)
+	}
+
+	// The warning names both files so that the user knows which one to rename
+	for _, name := range []string{"root@prod.pem", "ubuntu@prod.pem"} {
+		if !strings.Contains(log.String(), name) {
+			t.Errorf("Collision warning doesn't name %s: %q", name, log.String())
+		}
+	}
+}
+
+func TestLoadKeyOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awssh-test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"ubuntu@bastion.pem":      "",
+		"ubuntu@bastion.pem.json": `{"port": 2222, "jumpHost": "jump.example.com", "extraArgs": ["-o", "Compression=yes"]}`,
+		"plain.pem":               "",
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := loadSshKeysFromDir(newRunLogger(ioutil.Discard), dir)
+
+	if err != nil {
+		t.Fatalf("Error while loading keys: %s", err)
+	}
+
+	expected := keyOptions{Port: 2222, JumpHost: "jump.example.com", ExtraArgs: []string{"-o", "Compression=yes"}}
+
+	if key := keys["bastion"]; key == nil || !reflect.DeepEqual(key.options, expected) {
+		t.Errorf("Unexpected options for key bastion: got %v, expected %v", key, expected)
+	}
+
+	if key := keys["plain"]; key == nil || !reflect.DeepEqual(key.options, keyOptions{}) {
+		t.Errorf("Unexpected options for key plain: got %v, expected none", key)
+	}
+
+	instance := map[string]string{"instanceId": "i-1234", "ipAddress": "1.2.3.4"}
+	disableHostKeyCheck := true
+	conf := &config{DisableHostKeyCheck: &disableHostKeyCheck}
+	keyFile := path.Join(dir, "ubuntu@bastion.pem")
+
+	testData := []struct {
+		Flags *sshFlags
+		Argv  []string
+	}{
+		{
+			&sshFlags{connectBy: "ip", noDefaults: true},
+			[]string{"ssh", "-t", "-p", "2222", "-i", keyFile, "-J", "jump.example.com", "-o", "Compression=yes", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR", "ubuntu@1.2.3.4"},
+		},
+		{
+			&sshFlags{connectBy: "ip", noDefaults: true, port: 22},
+			[]string{"ssh", "-t", "-p", "22", "-i", keyFile, "-J", "jump.example.com", "-o", "Compression=yes", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-o", "LogLevel=ERROR", "ubuntu@1.2.3.4"},
+		},
+	}
+
+	for _, d := range testData {
+		argv, err := buildSSHCommand(instance, keys["bastion"], conf, d.Flags)
+
+		if err != nil || !reflect.DeepEqual(argv, d.Argv) {
+			t.Errorf("Unexpected ssh command for flags %+v: got %q (error: %v), expected %q", *d.Flags, argv, err, d.Argv)
+		}
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "plain.pem.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadSshKeysFromDir(newRunLogger(ioutil.Discard), dir); err == nil {
+		t.Errorf("Expected an error for an invalid key options file")
+	}
+}
+
+func TestMatchSummary(t *testing.T) {
+	testData := []struct {
+		States       []string
+		MatchFilters []string
+		EqualFilter  string
+		Summary      string
+	}{
+		{
+			[]string{"running"},
+			nil,
+			"",
+			"12 running instances, 3 matched in eu-west-1",
+		},
+		{
+			[]string{"running"},
+			[]string{"web"},
+			"",
+			"12 running instances, 3 matched (-m web) in eu-west-1",
+		},
+		{
+			[]string{"running"},
+			[]string{"prod", "web"},
+			"t3.large",
+			"12 running instances, 3 matched (-m prod -m web -e t3.large) in eu-west-1",
+		},
+		{
+			[]string{"stopped", "terminated"},
+			nil,
+			"",
+			"12 stopped or terminated instances, 3 matched in eu-west-1",
+		},
+	}
+
+	for _, d := range testData {
+		summary := matchSummary(12, 3, d.States, d.MatchFilters, d.EqualFilter, "eu-west-1")
+
+		if summary != d.Summary {
+			t.Errorf("Unexpected summary: got '%s', expected '%s'", summary, d.Summary)
+		}
+	}
+}
+
+func TestDescribeInstanceSingleLine(t *testing.T) {
+	instance := &ec2.Instance{
+		InstanceId: aws.String("i-1234"),
+		State:      &ec2.InstanceState{Code: aws.Int64(16), Name: aws.String("running")},
+		Placement:  &ec2.Placement{AvailabilityZone: aws.String("eu-west-1a")},
+		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda")},
+		},
+	}
+
+	var out bytes.Buffer
+	describeInstance(&out, collectInstanceData(instance), tableStyleBoxed)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+
+	// Header, separator and borders, plus one line per field
+	if expected := 4 + len(collectInstanceData(instance)); len(lines) != expected {
+		t.Fatalf("Unexpected number of lines: got %d, expected %d:\n%s", len(lines), expected, out.String())
+	}
+
+	for _, line := range lines {
+		if utf8.RuneCountInString(line) != utf8.RuneCountInString(lines[0]) {
+			t.Errorf("Misaligned table line %q in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestFlattenValue(t *testing.T) {
+	testData := []struct {
+		Value     string
+		Flattened string
+	}{
+		{"i-1234", "i-1234"},
+		{"two  spaces", "two  spaces"},
+		{"{\n  Code: 16,\n  Name: \"running\"\n}", "{ Code: 16, Name: \"running\" }"},
+		{"[{\n  DeviceName: \"/dev/xvda\"\n}]", "[{ DeviceName: \"/dev/xvda\" }]"},
+	}
+
+	for _, d := range testData {
+		if flattened := flattenValue(d.Value); flattened != d.Flattened {
+			t.Errorf("Unexpected flattened value for %q: got %q, expected %q", d.Value, flattened, d.Flattened)
+		}
+	}
+}
+
+func TestCollectInstanceData(t *testing.T) {
+	instance := &ec2.Instance{
+		InstanceId:   aws.String("i-1234"),
+		InstanceType: aws.String("t3.large"),
+		State:        &ec2.InstanceState{Code: aws.Int64(80), Name: aws.String("stopped")},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("web-1")},
+			{Key: aws.String("Env"), Value: aws.String("prod")},
+		},
+		SecurityGroups: []*ec2.GroupIdentifier{
+			{GroupId: aws.String("sg-1111"), GroupName: aws.String("web")},
+			{GroupId: aws.String("sg-2222"), GroupName: aws.String("ssh-access")},
+		},
+		VpcId: aws.String("vpc-1234"),
+	}
+
+	expected := map[string]string{
+		"instanceId":       "i-1234",
+		"instanceType":     "t3.large",
+		"state":            "stopped",
+		"tag:Name":         "web-1",
+		"tag:Env":          "prod",
+		"tags":             "Env=prod,Name=web-1",
+		"securityGroupIds": "sg-1111,sg-2222",
+		"securityGroups":   "web,ssh-access",
+		"vpcId":            "vpc-1234",
+	}
+
+	desc := collectInstanceData(instance)
+
+	for field, value := range expected {
+		if desc[field] != value {
+			t.Errorf("Unexpected value for field %s: got '%s', expected '%s'", field, desc[field], value)
+		}
+	}
+
+	if _, ok := desc["groupSet"]; ok {
+		t.Errorf("Unexpected groupSet field, security groups should only be in securityGroupIds and securityGroups")
+	}
+
+	for _, group := range []string{"sg-1111", "ssh-access"} {
+		if !instanceInSecurityGroup(desc, group) {
+			t.Errorf("Expected instance to be in security group %s", group)
+		}
+	}
+
+	for _, group := range []string{"sg-3333", "ssh", ""} {
+		if instanceInSecurityGroup(desc, group) {
+			t.Errorf("Unexpected match for security group '%s'", group)
+		}
+	}
+}
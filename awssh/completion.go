@@ -0,0 +1,131 @@
+package awssh
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// awsRegions is the list of regions offered when completing the -r flag.
+var awsRegions = []string{
+	"af-south-1",
+	"ap-east-1",
+	"ap-northeast-1",
+	"ap-northeast-2",
+	"ap-northeast-3",
+	"ap-south-1",
+	"ap-south-2",
+	"ap-southeast-1",
+	"ap-southeast-2",
+	"ap-southeast-3",
+	"ap-southeast-4",
+	"ca-central-1",
+	"ca-west-1",
+	"eu-central-1",
+	"eu-central-2",
+	"eu-north-1",
+	"eu-south-1",
+	"eu-south-2",
+	"eu-west-1",
+	"eu-west-2",
+	"eu-west-3",
+	"il-central-1",
+	"me-central-1",
+	"me-south-1",
+	"sa-east-1",
+	"us-east-1",
+	"us-east-2",
+	"us-west-1",
+	"us-west-2",
+}
+
+// completionShell returns the shell passed to the (hidden) -completion flag,
+// or an empty string if it's not in args. It is looked up before the regular
+// flag parsing so that the configuration doesn't need to be loaded.
+func completionShell(args []string) string {
+	return earlyStringFlag(args, "completion")
+}
+
+const bashCompletion = `_awssh() {
+	local cur prev
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+	if [ "$prev" = "-r" ]; then
+		COMPREPLY=($(compgen -W "%[2]s" -- "$cur"))
+		return
+	fi
+
+	COMPREPLY=($(compgen -W "%[1]s" -- "$cur"))
+}
+
+complete -F _awssh awssh
+`
+
+const zshCompletion = `#compdef awssh
+
+_awssh() {
+	local -a flags regions
+	flags=(%[1]s)
+	regions=(%[2]s)
+
+	if [[ "${words[CURRENT-1]}" == "-r" ]]; then
+		compadd -a regions
+	else
+		compadd -a flags
+	fi
+}
+
+compdef _awssh awssh
+`
+
+const fishCompletion = `complete -c awssh -f
+%[1]scomplete -c awssh -o r -x -a "%[2]s"
+`
+
+// writeCompletion writes to w a completion script for the given shell,
+// completing the flags defined in fs.
+func writeCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	flagNames := []string{}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		flagNames = append(flagNames, f.Name)
+	})
+
+	sort.Strings(flagNames)
+
+	regions := strings.Join(awsRegions, " ")
+
+	switch shell {
+	case "bash", "zsh":
+		dashed := make([]string, len(flagNames))
+
+		for i, name := range flagNames {
+			dashed[i] = "-" + name
+		}
+
+		script := bashCompletion
+
+		if shell == "zsh" {
+			script = zshCompletion
+		}
+
+		_, err := fmt.Fprintf(w, script, strings.Join(dashed, " "), regions)
+		return err
+	case "fish":
+		flagLines := ""
+
+		for _, name := range flagNames {
+			if name != "r" {
+				flagLines += fmt.Sprintf("complete -c awssh -o %s\n", name)
+			}
+		}
+
+		_, err := fmt.Fprintf(w, fishCompletion, flagLines, regions)
+		return err
+	}
+
+	return fmt.Errorf("Unsupported shell '%s', must be one of bash, zsh or fish", shell)
+}
@@ -0,0 +1,105 @@
+package awssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+)
+
+// sshPublicKey encodes pub in the OpenSSH authorized_keys format.
+func sshPublicKey(pub *rsa.PublicKey) string {
+	buf := bytes.NewBuffer(nil)
+
+	writeString := func(data []byte) {
+		binary.Write(buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+
+	writeMPInt := func(n *big.Int) {
+		data := n.Bytes()
+
+		// mpints are signed, add a leading 0 to keep them positive
+		if len(data) > 0 && data[0]&0x80 != 0 {
+			data = append([]byte{0}, data...)
+		}
+
+		writeString(data)
+	}
+
+	writeString([]byte("ssh-rsa"))
+	writeMPInt(big.NewInt(int64(pub.E)))
+	writeMPInt(pub.N)
+
+	return "ssh-rsa " + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// pushEphemeralKey generates a temporary SSH key and makes it valid for
+// username on instance using EC2 Instance Connect. The key is stored in a
+// temporary directory that the caller should remove once done.
+func pushEphemeralKey(sess *session.Session, instance map[string]string, username string) (*sshKey, error) {
+	if instance["platform"] == "windows" {
+		return nil, fmt.Errorf("Instance %s runs Windows, which does not support EC2 Instance Connect", instance["instanceId"])
+	}
+
+	if instance["availabilityZone"] == "" {
+		return nil, fmt.Errorf("Cannot determine the availability zone of instance %s", instance["instanceId"])
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "awssh")
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := &sshKey{
+		username: username,
+		filename: path.Join(dir, "eic.pem"),
+	}
+
+	keyData := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	if err := ioutil.WriteFile(key.filename, keyData, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	res, err := ec2instanceconnect.New(sess).SendSSHPublicKey(&ec2instanceconnect.SendSSHPublicKeyInput{
+		AvailabilityZone: aws.String(instance["availabilityZone"]),
+		InstanceId:       aws.String(instance["instanceId"]),
+		InstanceOSUser:   aws.String(username),
+		SSHPublicKey:     aws.String(sshPublicKey(&privateKey.PublicKey)),
+	})
+
+	if err == nil && !aws.BoolValue(res.Success) {
+		err = fmt.Errorf("request %s was not successful", aws.StringValue(res.RequestId))
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Cannot push SSH key to instance %s with EC2 Instance Connect, does it support it? %s", instance["instanceId"], err)
+	}
+
+	return key, nil
+}
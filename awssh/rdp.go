@@ -0,0 +1,136 @@
+package awssh
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// rdpUser is the user to log in as on Windows instances when -l is not given.
+const rdpUser = "Administrator"
+
+// rdpClients lists the RDP clients awssh knows how to launch, in order of
+// preference.
+var rdpClients = []string{"xfreerdp", "mstsc", "open"}
+
+// rdpArgs returns the command line launching client to connect to address as
+// username. If passwordFromStdin is set, xfreerdp reads the password from its
+// standard input. The other clients ask for it.
+func rdpArgs(client string, username string, address string, passwordFromStdin bool) []string {
+	switch client {
+	case "xfreerdp":
+		args := []string{"xfreerdp", "/v:" + address, "/u:" + username}
+
+		if passwordFromStdin {
+			// Set the (empty) domain, else xfreerdp would read it from stdin
+			// before the password
+			args = append(args, "/d:", "/from-stdin")
+		}
+
+		return args
+	case "mstsc":
+		return []string{"mstsc", "/v:" + address}
+	default:
+		// macOS opens rdp:// URLs with Microsoft Remote Desktop
+		return []string{"open", "rdp://full%20address=s:" + url.QueryEscape(address) + "&username=s:" + url.QueryEscape(username)}
+	}
+}
+
+// findRDPClient returns the path and name of the first RDP client found in
+// PATH.
+func findRDPClient() (string, string, error) {
+	for _, client := range rdpClients {
+		if bin, err := exec.LookPath(client); err == nil {
+			return bin, client, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("Could not find an RDP client in PATH (tried %s)", strings.Join(rdpClients, ", "))
+}
+
+// decryptWindowsPassword decrypts the base64 encoded password data returned
+// by GetPasswordData with the PEM encoded RSA private key of the instance.
+func decryptWindowsPassword(passwordData string, keyData []byte) (string, error) {
+	block, _ := pem.Decode(keyData)
+
+	if block == nil {
+		return "", fmt.Errorf("Key is not PEM encoded")
+	}
+
+	var privateKey *rsa.PrivateKey
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+
+		if err != nil {
+			return "", err
+		}
+
+		privateKey = key
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+		if err != nil {
+			return "", err
+		}
+
+		rsaKey, ok := key.(*rsa.PrivateKey)
+
+		if !ok {
+			return "", fmt.Errorf("Key is not an RSA key")
+		}
+
+		privateKey = rsaKey
+	default:
+		return "", fmt.Errorf("Unsupported key type '%s', only RSA keys in PEM format can decrypt Windows passwords", block.Type)
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(strings.TrimSpace(passwordData))
+
+	if err != nil {
+		return "", fmt.Errorf("Invalid password data: %s", err)
+	}
+
+	password, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encrypted)
+
+	if err != nil {
+		return "", fmt.Errorf("Cannot decrypt password: %s", err)
+	}
+
+	return string(password), nil
+}
+
+// getWindowsPassword fetches the Administrator password of instance with
+// client and decrypts it with the private key stored in keyFilename.
+func getWindowsPassword(client *ec2.EC2, instanceID string, keyFilename string) (string, error) {
+	keyData, err := ioutil.ReadFile(keyFilename)
+
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.GetPasswordData(&ec2.GetPasswordDataInput{
+		InstanceId: aws.String(instanceID),
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("Cannot get the password of instance %s: %s", instanceID, err)
+	}
+
+	if aws.StringValue(res.PasswordData) == "" {
+		return "", fmt.Errorf("The password of instance %s is not available (yet)", instanceID)
+	}
+
+	return decryptWindowsPassword(aws.StringValue(res.PasswordData), keyData)
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/abustany/awssh/awssh"
+)
+
+func main() {
+	os.Exit(awssh.Run(os.Args, os.Stdin, os.Stdout, os.Stderr))
+}